@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	block "github.com/scaleway/scaleway-sdk-go/api/block/v1alpha1"
+	"github.com/scaleway/scaleway-sdk-go/scw"
+	"github.com/scaleway/scaleway-sdk-go/validation"
+)
+
+// blockInterface is the part of the Block API used by VolumeSnapshotter.
+type blockInterface interface {
+	GetVolume(req *block.GetVolumeRequest, opts ...scw.RequestOption) (*block.Volume, error)
+	CreateVolume(req *block.CreateVolumeRequest, opts ...scw.RequestOption) (*block.Volume, error)
+	GetSnapshot(req *block.GetSnapshotRequest, opts ...scw.RequestOption) (*block.Snapshot, error)
+	CreateSnapshot(req *block.CreateSnapshotRequest, opts ...scw.RequestOption) (*block.Snapshot, error)
+	DeleteSnapshot(req *block.DeleteSnapshotRequest, opts ...scw.RequestOption) error
+	DeleteVolume(req *block.DeleteVolumeRequest, opts ...scw.RequestOption) error
+}
+
+// sbsVolumes snapshots and restores the Block Storage volumes of the SBS CSI
+// driver. Their IDs are stored without prefix, as before the Instance volumes
+// were supported.
+type sbsVolumes struct {
+	s *VolumeSnapshotter
+}
+
+func (b *sbsVolumes) idPrefix() string {
+	return ""
+}
+
+// createVolumeFromSnapshot restores a snapshot to a new volume, in the zone
+// of the snapshot as Block Storage snapshots cannot be restored in another
+// zone. It returns once the volume is available, deleting the volume when it
+// does not become available.
+func (b *sbsVolumes) createVolumeFromSnapshot(snapshotID zonedID, volumeAZ string, iops uint32) (zonedID, error) {
+	blockAPI, err := b.s.blockAPI()
+	if err != nil {
+		return zonedID{}, err
+	}
+
+	// describe the snapshot, so we can apply its tags to the volume
+	var snapshot *block.Snapshot
+	zone, err := b.s.callInZone("GetSnapshot", true, snapshotID, scw.Zone(volumeAZ), func(zone scw.Zone, opt scw.RequestOption) (err error) {
+		snapshot, err = blockAPI.GetSnapshot(&block.GetSnapshotRequest{
+			Zone:       zone,
+			SnapshotID: snapshotID.id,
+		}, opt)
+		return err
+	})
+	if err != nil {
+		return zonedID{}, errors.Wrapf(err, "error getting snapshot %s", snapshotID)
+	}
+	if snapshot == nil {
+		return zonedID{}, errors.Errorf("expected snapshot from GetSnapshot for %s", snapshotID)
+	}
+	if snapshot.Status != block.SnapshotStatusAvailable {
+		return zonedID{}, errors.Errorf("snapshot %s is %s, expected %s", snapshotID, snapshot.Status, block.SnapshotStatusAvailable)
+	}
+	if validation.IsZone(volumeAZ) && scw.Zone(volumeAZ) != zone {
+		return zonedID{}, errors.Errorf("snapshot %s is in zone %s, it cannot be restored in zone %s", snapshotID, zone, volumeAZ)
+	}
+
+	// filter tags through getTagsForCluster() function in order to apply
+	// proper ownership tags to restored volumes
+	input := &block.CreateVolumeRequest{
+		FromSnapshot: &block.CreateVolumeRequestFromSnapshot{
+			SnapshotID: snapshotID.id,
+		},
+		Zone: zone,
+	}
+	// without IOPS, the volume gets the IOPS of the snapshot
+	if iops > 0 {
+		input.PerfIops = scw.Uint32Ptr(iops)
+	}
+	if len(snapshot.Tags) > 0 {
+		input.Tags = getTagsForCluster(snapshot.Tags)
+	}
+
+	var volume *block.Volume
+	err = b.s.call("CreateVolume", false, func(opt scw.RequestOption) (err error) {
+		volume, err = blockAPI.CreateVolume(input, opt)
+		return err
+	})
+	if err != nil {
+		return zonedID{}, errors.Wrapf(err, "error creating volume from snapshot %s", snapshotID)
+	}
+
+	volumeID := zonedID{zone: volume.Zone, id: volume.ID}
+	err = b.s.waitForStatus("GetVolume", "volume", volumeID, b.s.volumeTimeout, block.VolumeStatusAvailable.String(), block.VolumeStatusError.String(), func(opt scw.RequestOption) (string, error) {
+		volume, err := blockAPI.GetVolume(&block.GetVolumeRequest{
+			Zone:     volumeID.zone,
+			VolumeID: volumeID.id,
+		}, opt)
+		if err != nil {
+			return "", err
+		}
+		return volume.Status.String(), nil
+	})
+	if err != nil {
+		// Velero does not know about the volume of a failed restore
+		deleteErr := b.s.call("DeleteVolume", true, func(opt scw.RequestOption) error {
+			return blockAPI.DeleteVolume(&block.DeleteVolumeRequest{
+				Zone:     volumeID.zone,
+				VolumeID: volumeID.id,
+			}, opt)
+		})
+		if deleteErr != nil && !isNotFound(deleteErr) {
+			b.s.log.WithError(deleteErr).WithField("volume", volumeID).Warn("Failed to delete the volume")
+		}
+		return zonedID{}, err
+	}
+
+	return volumeID, nil
+}
+
+func (b *sbsVolumes) getVolumeInfo(volumeID zonedID, hint scw.Zone) (string, *int64, error) {
+	volumeInfo, err := b.describeVolume(volumeID, hint)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var iops64 int64
+	if volumeInfo.Specs != nil && volumeInfo.Specs.PerfIops != nil {
+		iops64 = int64(*volumeInfo.Specs.PerfIops)
+	}
+
+	return volumeInfo.Type, &iops64, nil
+}
+
+// describeVolume returns a volume, looking for the volumes of legacy IDs in
+// the zone hint first.
+func (b *sbsVolumes) describeVolume(volumeID zonedID, hint scw.Zone) (block.Volume, error) {
+	blockAPI, err := b.s.blockAPI()
+	if err != nil {
+		return block.Volume{}, err
+	}
+
+	var output *block.Volume
+	_, err = b.s.callInZone("GetVolume", true, volumeID, hint, func(zone scw.Zone, opt scw.RequestOption) (err error) {
+		output, err = blockAPI.GetVolume(&block.GetVolumeRequest{
+			Zone:     zone,
+			VolumeID: volumeID.id,
+		}, opt)
+		return err
+	})
+	if err != nil {
+		b.s.log.Infof("failed to describe volume: %v", err)
+
+		return block.Volume{}, errors.WithStack(err)
+	}
+
+	if output == nil {
+		return block.Volume{}, errors.Errorf("Expected one volume from DescribeVolumes for volume ID %v", volumeID)
+	}
+
+	return *output, nil
+}
+
+// createSnapshot snapshots a volume, returning once the snapshot is available.
+func (b *sbsVolumes) createSnapshot(volumeID zonedID, snapshotName string, tags []string) (zonedID, error) {
+	// describe the volume, so we can copy its tags to the snapshot
+	volumeInfo, err := b.describeVolume(volumeID, "")
+	if err != nil {
+		return zonedID{}, err
+	}
+
+	blockAPI, err := b.s.blockAPI()
+	if err != nil {
+		return zonedID{}, err
+	}
+
+	tagsFromVolume := toTags(volumeInfo.Tags)
+	tagsMerged := tagsFromVolume.merge(tags)
+	input := &block.CreateSnapshotRequest{
+		VolumeID: volumeInfo.ID,
+		Tags:     tagsMerged,
+		Zone:     volumeInfo.Zone,
+		Name:     fmt.Sprintf("vol-%s-snap-%s", volumeInfo.Name, snapshotName),
+	}
+
+	var res *block.Snapshot
+	err = b.s.call("CreateSnapshot", false, func(opt scw.RequestOption) (err error) {
+		res, err = blockAPI.CreateSnapshot(input, opt)
+		return err
+	})
+	if err != nil {
+		return zonedID{}, errors.WithStack(err)
+	}
+
+	snapshotID := zonedID{zone: res.Zone, id: res.ID}
+	err = b.s.waitForStatus("GetSnapshot", "snapshot", snapshotID, b.s.snapshotTimeout, block.SnapshotStatusAvailable.String(), block.SnapshotStatusError.String(), func(opt scw.RequestOption) (string, error) {
+		snapshot, err := blockAPI.GetSnapshot(&block.GetSnapshotRequest{
+			Zone:       snapshotID.zone,
+			SnapshotID: snapshotID.id,
+		}, opt)
+		if err != nil {
+			return "", err
+		}
+		return snapshot.Status.String(), nil
+	})
+	if err != nil {
+		// Velero does not know about the snapshot of a failed backup
+		if deleteErr := b.deleteSnapshot(snapshotID); deleteErr != nil {
+			b.s.log.WithError(deleteErr).WithField("snapshot", snapshotID).Warn("Failed to delete the snapshot")
+		}
+		return zonedID{}, err
+	}
+
+	return snapshotID, nil
+}
+
+func (b *sbsVolumes) deleteSnapshot(snapshotID zonedID) error {
+	blockAPI, err := b.s.blockAPI()
+	if err != nil {
+		return err
+	}
+
+	_, err = b.s.callInZone("DeleteSnapshot", true, snapshotID, "", func(zone scw.Zone, opt scw.RequestOption) error {
+		return blockAPI.DeleteSnapshot(&block.DeleteSnapshotRequest{
+			Zone:       zone,
+			SnapshotID: snapshotID.id,
+		}, opt)
+	})
+
+	// if it's a NotFound error, we don't need to return an error
+	// since the snapshot is not there.
+	if isNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/pkg/errors"
+	"github.com/scaleway/scaleway-sdk-go/scw"
+)
+
+// bucketRegions caches the regions found by discoverBucketRegion, bucket names
+// being unique across the Scaleway regions.
+var bucketRegions = struct {
+	sync.Mutex
+	regions map[string]string
+}{regions: map[string]string{}}
+
+// discoverBucketRegion finds the Scaleway region owning bucket by probing the
+// endpoint of every region with HeadBucket. A region is only skipped when it
+// answers that the bucket is not there: any other failure, e.g. a timeout or
+// a denied access, is returned as the bucket could live in that region. Only
+// the regions found are cached.
+func discoverBucketRegion(ctx context.Context, client s3Interface, bucket string) (string, error) {
+	bucketRegions.Lock()
+	defer bucketRegions.Unlock()
+
+	if region, ok := bucketRegions.regions[bucket]; ok {
+		return region, nil
+	}
+
+	var tried []string
+	for _, region := range scw.AllRegions {
+		_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(bucket),
+		}, func(o *s3.Options) {
+			o.Region = string(region)
+		})
+		if err == nil {
+			bucketRegions.regions[bucket] = string(region)
+			return string(region), nil
+		}
+		if !isBucketNotInRegion(err) {
+			return "", errors.Wrapf(err, "error looking for bucket %s in region %s", bucket, region)
+		}
+		tried = append(tried, fmt.Sprintf("%s (%v)", region, err))
+	}
+
+	return "", errors.Errorf("unable to find bucket %s in any Scaleway region, tried: %s", bucket, strings.Join(tried, ", "))
+}
+
+// isBucketNotInRegion tells whether HeadBucket failed as the bucket does not
+// exist in the region of the endpoint, which answers 404, or redirects to the
+// endpoint of another region.
+func isBucketNotInRegion(err error) bool {
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchBucket" {
+		return true
+	}
+	var respErr *smithyhttp.ResponseError
+	return errors.As(err, &respErr) && (respErr.HTTPStatusCode() == http.StatusNotFound || respErr.HTTPStatusCode() == http.StatusMovedPermanently)
+}
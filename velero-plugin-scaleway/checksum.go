@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	checksumVerificationKey = "checksumVerification"
+
+	checksumVerificationOff     = "off"
+	checksumVerificationWarn    = "warn"
+	checksumVerificationEnforce = "enforce"
+
+	defaultChecksumVerification = checksumVerificationEnforce
+
+	// sdkChecksumValidationID is the middleware of the SDK validating the
+	// checksums of GetObject, replaced by checksumReader.
+	sdkChecksumValidationID = "AWSChecksum:ValidateOutputPayloadChecksum"
+)
+
+func parseChecksumVerification(config map[string]string) (string, error) {
+	switch mode := config[checksumVerificationKey]; mode {
+	case "":
+		return defaultChecksumVerification, nil
+	case checksumVerificationOff, checksumVerificationWarn, checksumVerificationEnforce:
+		return mode, nil
+	default:
+		return "", errors.Errorf("invalid %s %q, valid modes are %s, %s and %s", checksumVerificationKey, mode, checksumVerificationOff, checksumVerificationWarn, checksumVerificationEnforce)
+	}
+}
+
+// verifyChecksums tells whether GetObject verifies the checksums of the downloads.
+func (o *ObjectStore) verifyChecksums() bool {
+	return o.checksumVerification == checksumVerificationWarn || o.checksumVerification == checksumVerificationEnforce
+}
+
+// withoutSDKChecksumValidation removes the checksum validation of the SDK,
+// which only logs the composite checksums of multipart uploads it skips.
+func withoutSDKChecksumValidation(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		_, _ = stack.Deserialize.Remove(sdkChecksumValidationID)
+		return nil
+	})
+}
+
+// newChecksumHash returns the hash of a checksum algorithm returned by GetObject.
+func newChecksumHash(algorithm types.ChecksumAlgorithm) hash.Hash {
+	switch algorithm {
+	case types.ChecksumAlgorithmCrc32:
+		return crc32.NewIEEE()
+	case types.ChecksumAlgorithmCrc32c:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case types.ChecksumAlgorithmSha1:
+		return sha1.New()
+	default:
+		return sha256.New()
+	}
+}
+
+// expectedChecksum returns the checksum returned along with an object, and
+// its algorithm.
+func expectedChecksum(output *s3.GetObjectOutput) (types.ChecksumAlgorithm, string) {
+	for _, c := range []struct {
+		algorithm types.ChecksumAlgorithm
+		value     *string
+	}{
+		{types.ChecksumAlgorithmCrc32, output.ChecksumCRC32},
+		{types.ChecksumAlgorithmCrc32c, output.ChecksumCRC32C},
+		{types.ChecksumAlgorithmSha1, output.ChecksumSHA1},
+		{types.ChecksumAlgorithmSha256, output.ChecksumSHA256},
+	} {
+		if aws.ToString(c.value) != "" {
+			return c.algorithm, aws.ToString(c.value)
+		}
+	}
+	return "", ""
+}
+
+// verifyBody wraps the body of a download with a reader checking its
+// checksum. Multipart uploads carry a composite checksum, the checksum of the
+// checksums of their parts, so their part size is looked up first. Downloads
+// without checksum are returned as is.
+func (o *ObjectStore) verifyBody(bucket, key string, output *s3.GetObjectOutput, body io.ReadCloser) io.ReadCloser {
+	log := o.log.WithFields(
+		logrus.Fields{
+			"bucket": bucket,
+			"key":    key,
+		},
+	)
+
+	algorithm, expected := expectedChecksum(output)
+	if expected == "" {
+		log.Debug("Object has no checksum, skipping verification")
+		return body
+	}
+
+	r := &checksumReader{
+		body:      body,
+		log:       log.WithField("algorithm", algorithm),
+		key:       key,
+		algorithm: algorithm,
+		expected:  expected,
+		enforce:   o.checksumVerification == checksumVerificationEnforce,
+		hash:      newChecksumHash(algorithm),
+	}
+
+	if checksum, count, ok := strings.Cut(expected, "-"); ok {
+		parts, err := strconv.Atoi(count)
+		if err != nil || parts < 1 {
+			log.Warnf("Object has an invalid composite checksum %q, skipping verification", expected)
+			return body
+		}
+		partSize, err := o.partSize(bucket, key)
+		if err != nil {
+			log.WithError(err).Warn("Failed to get the part size of the object, skipping checksum verification")
+			return body
+		}
+		r.expected = checksum
+		r.parts = parts
+		r.partSize = partSize
+		r.composite = newChecksumHash(algorithm)
+	}
+	return r
+}
+
+// partSize returns the size of the first part of a multipart upload, which
+// is the size of every part but the last one.
+func (o *ObjectStore) partSize(bucket, key string) (int64, error) {
+	input := &s3.HeadObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(key),
+		PartNumber: aws.Int32(1),
+	}
+	if o.sseCustomerKey != "" {
+		input.SSECustomerAlgorithm = aws.String("AES256")
+		input.SSECustomerKey = &o.sseCustomerKey
+	}
+
+	op := newOperation("HeadObject", o.metadataTimeout)
+	defer op.done()
+
+	head, err := o.s3.HeadObject(op.ctx, input)
+	if err != nil {
+		return 0, errors.WithStack(op.wrap(err))
+	}
+	if aws.ToInt64(head.ContentLength) < 1 {
+		return 0, errors.Errorf("invalid part size %d", aws.ToInt64(head.ContentLength))
+	}
+	return aws.ToInt64(head.ContentLength), nil
+}
+
+// checksumReader computes the checksum of a download while it is read, and
+// compares it with the expected checksum at EOF.
+type checksumReader struct {
+	body      io.ReadCloser
+	log       logrus.FieldLogger
+	key       string
+	algorithm types.ChecksumAlgorithm
+	expected  string
+	enforce   bool
+	hash      hash.Hash
+
+	// composite checksums hash the checksums of the parts.
+	composite hash.Hash
+	parts     int
+	partSize  int64
+	partRead  int64
+	partsRead int
+
+	verified bool
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.write(p[:n])
+	if err == io.EOF && !r.verified {
+		r.verified = true
+		if verifyErr := r.verify(); verifyErr != nil {
+			if r.enforce {
+				return n, verifyErr
+			}
+			r.log.WithError(verifyErr).Warn("Checksum verification failed")
+		}
+	}
+	return n, err
+}
+
+// write hashes data, ending the current part at part boundaries.
+func (r *checksumReader) write(data []byte) {
+	if r.composite == nil {
+		r.hash.Write(data)
+		return
+	}
+	for len(data) > 0 {
+		n := int(min(int64(len(data)), r.partSize-r.partRead))
+		r.hash.Write(data[:n])
+		r.partRead += int64(n)
+		data = data[n:]
+		if r.partRead == r.partSize {
+			r.endPart()
+		}
+	}
+}
+
+func (r *checksumReader) endPart() {
+	r.composite.Write(r.hash.Sum(nil))
+	r.hash.Reset()
+	r.partRead = 0
+	r.partsRead++
+}
+
+func (r *checksumReader) verify() error {
+	sum := r.hash
+	if r.composite != nil {
+		if r.partRead > 0 {
+			r.endPart()
+		}
+		if r.partsRead != r.parts {
+			return &ChecksumMismatchError{
+				Key:       r.key,
+				Algorithm: string(r.algorithm),
+				Expected:  r.expected + "-" + strconv.Itoa(r.parts),
+				Actual:    strconv.Itoa(r.partsRead) + " parts",
+			}
+		}
+		sum = r.composite
+	}
+
+	actual := base64.StdEncoding.EncodeToString(sum.Sum(nil))
+	if actual != r.expected {
+		return &ChecksumMismatchError{
+			Key:       r.key,
+			Algorithm: string(r.algorithm),
+			Expected:  r.expected,
+			Actual:    actual,
+		}
+	}
+	r.log.Debug("Checksum verified")
+	return nil
+}
+
+func (r *checksumReader) Close() error {
+	return r.body.Close()
+}
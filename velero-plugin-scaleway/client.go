@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"sync"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/pkg/errors"
 	"github.com/scaleway/scaleway-sdk-go/logger"
 	"github.com/scaleway/scaleway-sdk-go/scw"
@@ -13,8 +16,9 @@ import (
 
 // client Builder
 type clientBuilder struct {
-	log  logrus.FieldLogger
-	opts []scw.ClientOption
+	log   logrus.FieldLogger
+	opts  []scw.ClientOption
+	chain *ScalewayCredentialsChain
 }
 
 func newClientBuilder(logger logrus.FieldLogger) *clientBuilder {
@@ -35,49 +39,148 @@ func (c *clientBuilder) WithUserAgent(userAgent string) *clientBuilder {
 	return c
 }
 
+// WithRetryAfter records the Retry-After of the responses for the retry policy.
+func (c *clientBuilder) WithRetryAfter() *clientBuilder {
+	c.opts = append(c.opts, scw.WithHTTPClient(newRetryAfterHTTPClient()))
+
+	return c
+}
+
 func (c *clientBuilder) WithRegion(region string) *clientBuilder {
 	c.opts = append(c.opts, scw.WithDefaultRegion(scw.Region(region)))
 
 	return c
 }
 
+// WithCredentialsChain authenticates the client with the credentials of the
+// chain instead of the ones of the profile and the environment.
+func (c *clientBuilder) WithCredentialsChain(chain *ScalewayCredentialsChain) *clientBuilder {
+	c.chain = chain
+
+	return c
+}
+
 func (c *clientBuilder) Build(configPath string, profileName string) (*scw.Client, error) {
-	profile := scw.LoadEnvProfile()
+	return c.build(configPath, profileName, validateClient)
+}
 
-	// Default path is based on the following priority order:
-	// * The config file's path provided via --config flag
-	// * $SCW_CONFIG_PATH
-	// * $XDG_CONFIG_HOME/scw/config.yaml
-	// * $HOME/.config/scw/config.yaml
-	// * $USERPROFILE/.config/scw/config.yaml
-	configFromPath, err := scw.LoadConfigFromPath(configPath)
-	switch {
-	case errIsConfigFileNotFound(err):
-		// no config file was found -> nop
+// BuildRegional builds a client for the regional APIs, such as Key Manager,
+// which need neither a default organization nor a default zone.
+func (c *clientBuilder) BuildRegional(configPath string, profileName string) (*scw.Client, error) {
+	return c.build(configPath, profileName, validateRegionalClient)
+}
 
-	case err != nil:
-		// failed to read the config file -> fail
+func (c *clientBuilder) build(configPath string, profileName string, validate func(client *scw.Client) error) (*scw.Client, error) {
+	profile, err := loadSCWProfile(configPath, profileName)
+	if err != nil {
 		return nil, err
+	}
 
-	default:
-		// found and loaded a config file -> merge with env
-		activeProfile, err := configFromPath.GetProfile(profileName)
+	opts := append([]scw.ClientOption{scw.WithProfile(profile)}, c.opts...)
+	if c.chain != nil {
+		// set last so it overrides the keys of the profile and of the environment
+		authOpt, err := c.chain.ClientOption(context.Background())
 		if err != nil {
 			return nil, err
 		}
+		opts = append(opts, authOpt)
+	}
 
-		// Creates a client from the active profile
-		// It will trigger a validation step on its configuration to catch errors if any
-		opts := []scw.ClientOption{
-			scw.WithProfile(activeProfile),
-		}
+	client, err := scw.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
 
-		_, err = scw.NewClient(opts...)
-		if err != nil {
-			return nil, err
-		}
+	return client, validate(client)
+}
+
+// BuildReloading builds a client that follows the credentials rotations of the
+// credentials chain.
+func (c *clientBuilder) BuildReloading(configPath string, profileName string) (*scwClientReloader, error) {
+	return c.buildReloading(func() (*scw.Client, error) {
+		return c.Build(configPath, profileName)
+	})
+}
+
+// BuildRegionalReloading is the BuildRegional counterpart of BuildReloading.
+func (c *clientBuilder) BuildRegionalReloading(configPath string, profileName string) (*scwClientReloader, error) {
+	return c.buildReloading(func() (*scw.Client, error) {
+		return c.BuildRegional(configPath, profileName)
+	})
+}
 
-		profile = scw.MergeProfiles(activeProfile, profile)
+func (c *clientBuilder) buildReloading(build func() (*scw.Client, error)) (*scwClientReloader, error) {
+	if c.chain == nil {
+		return nil, errors.New("a credentials chain is required to reload the client")
+	}
+
+	r := &scwClientReloader{
+		log:   c.log,
+		chain: c.chain,
+		build: build,
+	}
+	if _, err := r.Client(context.Background()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// scwClientReloader hands out a Scaleway client authenticated with the current
+// credentials of the chain. The client is rebuilt after a rotation, requests
+// in flight finish with the client they started with.
+type scwClientReloader struct {
+	log   logrus.FieldLogger
+	chain *ScalewayCredentialsChain
+	build func() (*scw.Client, error)
+
+	mu     sync.Mutex
+	creds  aws.Credentials
+	client *scw.Client
+}
+
+// Client returns the client for the current credentials.
+func (r *scwClientReloader) Client(ctx context.Context) (*scw.Client, error) {
+	creds, err := r.chain.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.client != nil && creds.AccessKeyID == r.creds.AccessKeyID && creds.SecretAccessKey == r.creds.SecretAccessKey {
+		return r.client, nil
+	}
+
+	client, err := r.build()
+	if err != nil {
+		return nil, err
+	}
+	if r.client != nil {
+		r.log.WithField("accessKey", creds.AccessKeyID).Info("Scaleway client rebuilt with rotated credentials")
+	}
+	r.client = client
+	r.creds = creds
+	return client, nil
+}
+
+// loadSCWProfile loads the Scaleway profile shared by the object store and the
+// volume snapshotter. Settings are resolved in the following order, the first
+// one set wins:
+// * the environment variables (SCW_DEFAULT_REGION, SCW_DEFAULT_ZONE, ...)
+// * the given profile of the config file, or its active profile when profileName is empty
+// * the root profile of the config file
+//
+// Credentials follow the order of ScalewayCredentialsChain instead.
+func loadSCWProfile(configPath string, profileName string) (*scw.Profile, error) {
+	profile := scw.LoadEnvProfile()
+
+	configProfile, err := loadSCWConfigProfile(configPath, profileName)
+	if err != nil {
+		return nil, err
+	}
+	if configProfile != nil {
+		profile = scw.MergeProfiles(configProfile, profile)
 	}
 
 	// If profile have a defaultZone but no defaultRegion we set the defaultRegion
@@ -94,43 +197,58 @@ func (c *clientBuilder) Build(configPath string, profileName string) (*scw.Clien
 		}
 	}
 
-	client, err := scw.NewClient(c.opts...)
-	if err != nil {
+	return profile, nil
+}
+
+// loadSCWConfigProfile loads a profile from the Scaleway config file, without
+// merging the environment. It returns a nil profile when there is no config file.
+func loadSCWConfigProfile(configPath string, profileName string) (*scw.Profile, error) {
+	// Default path is based on the following priority order:
+	// * The config file's path provided via --config flag
+	// * $SCW_CONFIG_PATH
+	// * $XDG_CONFIG_HOME/scw/config.yaml
+	// * $HOME/.config/scw/config.yaml
+	// * $USERPROFILE/.config/scw/config.yaml
+	configFromPath, err := scw.LoadConfigFromPath(configPath)
+	switch {
+	case errIsConfigFileNotFound(err):
+		// no config file was found -> nop
+		return nil, nil
+
+	case err != nil:
+		// failed to read the config file -> fail
 		return nil, err
 	}
 
-	return client, validateClient(client)
-}
-
-// validateClient validate a client configuration and make sure all mandatory setting are present.
-// This function is only call for commands that require a valid client.
-func validateClient(client *scw.Client) error {
-	accessKey, _ := client.GetAccessKey()
-	if accessKey == "" {
-		return &ClientSCWError{
-			Err:     fmt.Errorf("access key is required"),
-			Details: configErrorDetails("access_key", "SCW_ACCESS_KEY"),
-		}
+	var activeProfile *scw.Profile
+	if profileName == "" {
+		activeProfile, err = configFromPath.GetActiveProfile()
+	} else {
+		activeProfile, err = configFromPath.GetProfile(profileName)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	if !validation.IsAccessKey(accessKey) {
-		return &ClientSCWError{
-			Err: fmt.Errorf("invalid access key format '%s', expected SCWXXXXXXXXXXXXXXXXX format", accessKey),
-		}
+	// Creates a client from the active profile
+	// It will trigger a validation step on its configuration to catch errors if any
+	opts := []scw.ClientOption{
+		scw.WithProfile(activeProfile),
 	}
 
-	secretKey, _ := client.GetSecretKey()
-	if secretKey == "" {
-		return &ClientSCWError{
-			Err:     fmt.Errorf("secret key is required"),
-			Details: configErrorDetails("secret_key", "SCW_SECRET_KEY"),
-		}
+	_, err = scw.NewClient(opts...)
+	if err != nil {
+		return nil, err
 	}
 
-	if !validation.IsSecretKey(secretKey) {
-		return &ClientSCWError{
-			Err: fmt.Errorf("invalid secret key format '%s', expected a UUID: xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx", secretKey),
-		}
+	return activeProfile, nil
+}
+
+// validateClient validate a client configuration and make sure all mandatory setting are present.
+// This function is only call for commands that require a valid client.
+func validateClient(client *scw.Client) error {
+	if err := validateCredentials(client); err != nil {
+		return err
 	}
 
 	defaultOrganizationID, _ := client.GetDefaultOrganizationID()
@@ -165,6 +283,51 @@ func validateClient(client *scw.Client) error {
 		}
 	}
 
+	return validateDefaultRegion(client)
+}
+
+// validateRegionalClient validates the configuration of a client of a regional
+// API, which only needs the credentials and the region.
+func validateRegionalClient(client *scw.Client) error {
+	if err := validateCredentials(client); err != nil {
+		return err
+	}
+	return validateDefaultRegion(client)
+}
+
+func validateCredentials(client *scw.Client) error {
+	accessKey, _ := client.GetAccessKey()
+	if accessKey == "" {
+		return &ClientSCWError{
+			Err:     fmt.Errorf("access key is required"),
+			Details: configErrorDetails("access_key", "SCW_ACCESS_KEY"),
+		}
+	}
+
+	if !validation.IsAccessKey(accessKey) {
+		return &ClientSCWError{
+			Err: fmt.Errorf("invalid access key format '%s', expected SCWXXXXXXXXXXXXXXXXX format", accessKey),
+		}
+	}
+
+	secretKey, _ := client.GetSecretKey()
+	if secretKey == "" {
+		return &ClientSCWError{
+			Err:     fmt.Errorf("secret key is required"),
+			Details: configErrorDetails("secret_key", "SCW_SECRET_KEY"),
+		}
+	}
+
+	if !validation.IsSecretKey(secretKey) {
+		return &ClientSCWError{
+			Err: fmt.Errorf("invalid secret key format '%s', expected a UUID: xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx", secretKey),
+		}
+	}
+
+	return nil
+}
+
+func validateDefaultRegion(client *scw.Client) error {
 	defaultRegion, _ := client.GetDefaultRegion()
 	if defaultRegion == "" {
 		return &ClientSCWError{
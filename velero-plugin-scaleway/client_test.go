@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/scaleway/scaleway-sdk-go/scw"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unsetSCWEnv clears the Scaleway environment for the duration of the test.
+func unsetSCWEnv(t *testing.T) {
+	t.Helper()
+
+	for _, key := range []string{
+		scw.ScwAccessKeyEnv,
+		scw.ScwSecretKeyEnv,
+		scw.ScwDefaultRegionEnv,
+		scw.ScwDefaultZoneEnv,
+		scw.ScwDefaultOrganizationIDEnv,
+		scw.ScwDefaultProjectIDEnv,
+		scw.ScwActiveProfileEnv,
+		scw.ScwConfigPathEnv,
+	} {
+		t.Setenv(key, "")
+		require.NoError(t, os.Unsetenv(key))
+	}
+}
+
+func TestLoadSCWProfile(t *testing.T) {
+	configPath := writeTestFile(t, "config.yaml", testYAMLCredentials+"    default_zone: nl-ams-1\n")
+
+	tests := []struct {
+		name              string
+		env               map[string]string
+		profile           string
+		expectedAccessKey string
+		expectedRegion    string
+	}{
+		{
+			name:              "root profile",
+			expectedAccessKey: testAccessKey,
+		},
+		{
+			name:              "named profile, region guessed from the zone",
+			profile:           "other",
+			expectedAccessKey: testOtherAccessKey,
+			expectedRegion:    "nl-ams",
+		},
+		{
+			name:              "environment has priority over the config file",
+			env:               map[string]string{scw.ScwAccessKeyEnv: "SCWZZZZZZZZZZZZZZZZZ", scw.ScwDefaultRegionEnv: "pl-waw"},
+			profile:           "other",
+			expectedAccessKey: "SCWZZZZZZZZZZZZZZZZZ",
+			expectedRegion:    "pl-waw",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			unsetSCWEnv(t)
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			profile, err := loadSCWProfile(configPath, tc.profile)
+			require.NoError(t, err)
+			require.NotNil(t, profile.AccessKey)
+			assert.Equal(t, tc.expectedAccessKey, *profile.AccessKey)
+			if tc.expectedRegion == "" {
+				assert.Nil(t, profile.DefaultRegion)
+			} else {
+				require.NotNil(t, profile.DefaultRegion)
+				assert.Equal(t, tc.expectedRegion, *profile.DefaultRegion)
+			}
+		})
+	}
+}
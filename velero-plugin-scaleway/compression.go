@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	compressionKey        = "compression"
+	compressionLevelKey   = "compressionLevel"
+	compressionMinSizeKey = "compressionMinSize"
+
+	compressionNone = "none"
+	compressionZstd = "zstd"
+
+	defaultCompressionMinSize = 4 * 1024
+	// maxCompressionMinSize bounds the head of the objects kept in memory to
+	// tell whether they are worth compressing.
+	maxCompressionMinSize = 64 * 1024 * 1024
+
+	// compressionMetadataKey marks the compressed objects, stored as a x-amz-meta-* header.
+	compressionMetadataKey = "compression"
+)
+
+// alreadyCompressedExts are the extensions of the objects stored as is, as
+// compressing them again would only cost CPU.
+var alreadyCompressedExts = []string{".gz", ".zst", ".tgz"}
+
+// compression is the compression applied by PutObject.
+type compression struct {
+	algorithm string
+	level     zstd.EncoderLevel
+	// minSize is the size under which objects are stored as is.
+	minSize int64
+}
+
+// parseCompression reads the compression settings from the BSL config. The
+// level is a zstd level, from 1 (fastest) to 22 (best), the minimum size
+// accepts Kubernetes quantities up to 64Mi, e.g. 64Ki.
+func parseCompression(config map[string]string) (compression, error) {
+	c := compression{
+		algorithm: compressionNone,
+		level:     zstd.SpeedDefault,
+		minSize:   defaultCompressionMinSize,
+	}
+
+	switch algorithm := config[compressionKey]; algorithm {
+	case "", compressionNone:
+	case compressionZstd:
+		c.algorithm = compressionZstd
+	default:
+		return compression{}, errors.Errorf("invalid %s %q, valid values are %s and %s", compressionKey, algorithm, compressionNone, compressionZstd)
+	}
+
+	if value := config[compressionLevelKey]; value != "" {
+		level, err := strconv.Atoi(value)
+		if err != nil || level < 1 || level > 22 {
+			return compression{}, errors.Errorf("could not parse %s (expected an integer between 1 and 22): %s", compressionLevelKey, value)
+		}
+		c.level = zstd.EncoderLevelFromZstd(level)
+	}
+
+	if value := config[compressionMinSizeKey]; value != "" {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil || quantity.Value() < 0 {
+			return compression{}, errors.Errorf("could not parse %s (expected a size such as 4Ki): %s", compressionMinSizeKey, value)
+		}
+		if quantity.Value() > maxCompressionMinSize {
+			return compression{}, errors.Errorf("%s must be at most 64Mi, got %s", compressionMinSizeKey, value)
+		}
+		c.minSize = quantity.Value()
+	}
+
+	return c, nil
+}
+
+// compressBody returns body compressed when it is worth it, with the metadata
+// marking the object as compressed. Closing the returned body stops the
+// compression of an upload that failed.
+func (c compression) compressBody(key string, body io.Reader) (io.ReadCloser, map[string]string, error) {
+	if c.algorithm != compressionZstd || hasAlreadyCompressedExt(key) {
+		return io.NopCloser(body), nil, nil
+	}
+
+	// the head grows with the data read, small objects only cost their size
+	head, err := io.ReadAll(io.LimitReader(body, c.minSize))
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if int64(len(head)) < c.minSize {
+		// smaller than the minimum size
+		return io.NopCloser(bytes.NewReader(head)), nil, nil
+	}
+	body = io.MultiReader(bytes.NewReader(head), body)
+
+	pr, pw := io.Pipe()
+	encoder, err := zstd.NewWriter(pw, zstd.WithEncoderLevel(c.level), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	go func() {
+		_, err := io.Copy(encoder, body)
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, map[string]string{compressionMetadataKey: compressionZstd}, nil
+}
+
+func hasAlreadyCompressedExt(key string) bool {
+	ext := strings.ToLower(path.Ext(key))
+	for _, compressed := range alreadyCompressedExts {
+		if ext == compressed {
+			return true
+		}
+	}
+	return false
+}
+
+// decompressBody returns the content of an object compressed by PutObject,
+// objects without the compression marker being returned as is.
+func decompressBody(body io.ReadCloser, metadata map[string]string) (io.ReadCloser, error) {
+	switch algorithm := metadata[compressionMetadataKey]; algorithm {
+	case "":
+		return body, nil
+	case compressionZstd:
+		decoder, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &zstdReadCloser{decoder: decoder, body: body}, nil
+	default:
+		return nil, errors.Errorf("unsupported compression %q", algorithm)
+	}
+}
+
+// zstdReadCloser releases the decoder along with the body it reads.
+type zstdReadCloser struct {
+	decoder *zstd.Decoder
+	body    io.Closer
+}
+
+func (r *zstdReadCloser) Read(p []byte) (int, error) {
+	return r.decoder.Read(p)
+}
+
+func (r *zstdReadCloser) Close() error {
+	r.decoder.Close()
+	return r.body.Close()
+}
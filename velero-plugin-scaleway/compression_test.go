@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCompression(t *testing.T) {
+	c, err := parseCompression(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, compression{algorithm: compressionNone, level: zstd.SpeedDefault, minSize: 4 * 1024}, c)
+
+	c, err = parseCompression(map[string]string{
+		compressionKey:        "zstd",
+		compressionLevelKey:   "19",
+		compressionMinSizeKey: "1Mi",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, compression{algorithm: compressionZstd, level: zstd.SpeedBestCompression, minSize: 1024 * 1024}, c)
+
+	c, err = parseCompression(map[string]string{compressionMinSizeKey: "64Mi"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(maxCompressionMinSize), c.minSize)
+
+	for _, config := range []map[string]string{
+		{compressionKey: "gzip"},
+		{compressionLevelKey: "0"},
+		{compressionLevelKey: "best"},
+		{compressionMinSizeKey: "-1"},
+		{compressionMinSizeKey: "10Gi"},
+	} {
+		_, err := parseCompression(config)
+		assert.Error(t, err, config)
+	}
+}
+
+func TestCompressBody(t *testing.T) {
+	c := compression{algorithm: compressionZstd, level: zstd.SpeedDefault, minSize: 16}
+	resourceList := strings.Repeat(`{"v1/Pod":["default/nginx"]},`, 1000)
+
+	tests := []struct {
+		name       string
+		key        string
+		content    string
+		compressed bool
+	}{
+		{
+			name:       "already gzipped",
+			key:        "backups/b1/b1-resource-list.json.gz",
+			content:    resourceList,
+			compressed: false,
+		},
+		{
+			name:       "large logs",
+			key:        "backups/b1/b1-logs",
+			content:    resourceList,
+			compressed: true,
+		},
+		{
+			name:       "exactly the minimum size",
+			key:        "backups/b1/velero-backup.json",
+			content:    strings.Repeat("a", 16),
+			compressed: true,
+		},
+		{
+			name:    "smaller than the minimum size",
+			key:     "backups/b1/velero-backup.json",
+			content: "{}",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body, metadata, err := c.compressBody(tc.key, strings.NewReader(tc.content))
+			require.NoError(t, err)
+			stored, err := io.ReadAll(body)
+			require.NoError(t, err)
+			require.NoError(t, body.Close())
+
+			if !tc.compressed {
+				assert.Empty(t, metadata)
+				assert.Equal(t, tc.content, string(stored))
+				return
+			}
+			assert.Equal(t, map[string]string{compressionMetadataKey: compressionZstd}, metadata)
+
+			content, err := decompressBody(io.NopCloser(bytes.NewReader(stored)), metadata)
+			require.NoError(t, err)
+			data, err := io.ReadAll(content)
+			require.NoError(t, err)
+			assert.Equal(t, tc.content, string(data))
+			require.NoError(t, content.Close())
+		})
+	}
+}
+
+func TestCompressBodyDoesNotPreallocateMinSize(t *testing.T) {
+	c := compression{algorithm: compressionZstd, level: zstd.SpeedDefault, minSize: maxCompressionMinSize}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	body, metadata, err := c.compressBody("backups/b1/velero-backup.json", strings.NewReader("{}"))
+	runtime.ReadMemStats(&after)
+	require.NoError(t, err)
+	assert.Nil(t, metadata)
+
+	// the small object costs its size, not the minimum size
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1024*1024))
+	data, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "{}", string(data))
+}
+
+func TestCompressionDisabled(t *testing.T) {
+	body, metadata, err := compression{algorithm: compressionNone}.compressBody("k", strings.NewReader("data"))
+	require.NoError(t, err)
+	assert.Nil(t, metadata)
+	data, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestGetObjectDecompresses(t *testing.T) {
+	w, err := newFileKeyWrapper(writeKeyFile(t, "k1"))
+	require.NoError(t, err)
+
+	content := strings.Repeat("resource list ", 1000)
+	c := compression{algorithm: compressionZstd, level: zstd.SpeedDefault}
+
+	compressed, metadata, err := c.compressBody("compressed", strings.NewReader(content))
+	require.NoError(t, err)
+	stored, err := io.ReadAll(compressed)
+	require.NoError(t, err)
+
+	// compressed, then encrypted as PutObject does
+	compressed, compressedMetadata, err := c.compressBody("encrypted", strings.NewReader(content))
+	require.NoError(t, err)
+	encrypted, encryptedMetadata, err := encryptBody(context.Background(), w, compressed)
+	require.NoError(t, err)
+	storedEncrypted, err := io.ReadAll(encrypted)
+	require.NoError(t, err)
+	for k, v := range compressedMetadata {
+		encryptedMetadata[k] = v
+	}
+
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	s.On("GetObject", mock.Anything, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("compressed")}).Return(&s3.GetObjectOutput{
+		Body:     io.NopCloser(bytes.NewReader(stored)),
+		Metadata: metadata,
+	}, nil)
+	s.On("GetObject", mock.Anything, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("encrypted")}).Return(&s3.GetObjectOutput{
+		Body:     io.NopCloser(bytes.NewReader(storedEncrypted)),
+		Metadata: encryptedMetadata,
+	}, nil)
+
+	o := &ObjectStore{
+		log:        newLogger(),
+		s3:         s,
+		keyWrapper: w,
+	}
+
+	for _, key := range []string{"compressed", "encrypted"} {
+		body, err := o.GetObject("b", key)
+		require.NoError(t, err)
+		data, err := io.ReadAll(body)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data), key)
+		require.NoError(t, body.Close())
+	}
+}
@@ -2,22 +2,54 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"slices"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
 	"github.com/pkg/errors"
-	"github.com/scaleway/scaleway-sdk-go/scw"
 	"github.com/sirupsen/logrus"
 )
 
 const userAgentPrefix = "velero-plugin-scaleway"
 
 type configBuilder struct {
-	log        logrus.FieldLogger
-	opts       []func(*config.LoadOptions) error
-	optsScwReq []scw.RequestOption
-	credsFlag  bool
+	log       logrus.FieldLogger
+	opts      []func(*config.LoadOptions) error
+	credsFlag bool
+	// transportOpts customize the HTTP transport of the clients, which keep
+	// the default transport when there are none.
+	transportOpts []func(*http.Transport)
+	// responseTimeout bounds the wait for the response headers, see WithResponseTimeout.
+	responseTimeout time.Duration
+}
+
+// unboundedResponseOperations are the S3 operations whose response may take
+// longer than the response timeout: the endpoint assembles the parts of a
+// large multipart upload before answering CompleteMultipartUpload, and a
+// client giving up would retry a completion already in progress.
+var unboundedResponseOperations = []string{"CompleteMultipartUpload"}
+
+// responseTimeoutClient sends the requests of the unboundedResponseOperations
+// through a client without response timeout, they are only bounded by the
+// timeout of their operation.
+type responseTimeoutClient struct {
+	bounded   aws.HTTPClient
+	unbounded aws.HTTPClient
+}
+
+func (c *responseTimeoutClient) Do(req *http.Request) (*http.Response, error) {
+	if slices.Contains(unboundedResponseOperations, awsmiddleware.GetOperationName(req.Context())) {
+		return c.unbounded.Do(req)
+	}
+	return c.bounded.Do(req)
 }
 
 func newConfigBuilder(logger logrus.FieldLogger) *configBuilder {
@@ -30,6 +62,7 @@ func newS3Client(cfg aws.Config, url string, forcePathStyle bool) (*s3.Client, e
 	opts := []func(*s3.Options){
 		func(o *s3.Options) {
 			o.UsePathStyle = forcePathStyle
+			o.EndpointResolverV2 = NewScalewayEndpointResolver()
 		},
 	}
 	if url != "" {
@@ -44,48 +77,97 @@ func newS3Client(cfg aws.Config, url string, forcePathStyle bool) (*s3.Client, e
 	return s3.NewFromConfig(cfg, opts...), nil
 }
 
-func (cb *configBuilder) WithSCWCredentials() *configBuilder {
-	// Create a new provider, specify the environment variable names that store your credentials
-	provider := NewScalewayCredentialsProvider("SCW_ACCESS_KEY", "SCW_SECRET_KEY")
-	cb.opts = append(cb.opts, config.WithCredentialsProvider(provider))
+// WithCredentialsChain signs the S3 requests with the credentials of the chain.
+func (cb *configBuilder) WithCredentialsChain(chain *ScalewayCredentialsChain) *configBuilder {
+	cb.opts = append(cb.opts, config.WithCredentialsProvider(chain))
+	// surface an unreadable credentials file at Init rather than on the first request
+	cb.credsFlag = chain.explicit
 	return cb
 }
 
-func (cb *configBuilder) WithSCWURL() *configBuilder {
-	resolver := NewScalewayEndpointResolver("SCW_S3_ENDPOINT", "SCW_REGION")
-	cb.opts = append(cb.opts, config.WithEndpointResolverWithOptions(resolver))
-
+// WithTLSConfig makes every client built from the resulting config use a
+// transport with the given TLS settings. A nil tlsConfig keeps the default transport.
+func (cb *configBuilder) WithTLSConfig(tlsConfig *tls.Config) *configBuilder {
+	if tlsConfig == nil {
+		return cb
+	}
+	cb.transportOpts = append(cb.transportOpts, func(tr *http.Transport) {
+		tr.TLSClientConfig = tlsConfig
+	})
 	return cb
 }
 
-func (cb *configBuilder) WithRegion(region string) *configBuilder {
-	cb.optsScwReq = append(
-		cb.optsScwReq,
-		scw.WithRegions([]scw.Region{scw.Region(region)}...),
-	)
+// WithResponseTimeout bounds the wait for the response of S3 once a request
+// was sent, so that a stalled endpoint fails the request whereas a slow
+// upload source does not. The unboundedResponseOperations are not bounded. A
+// zero timeout keeps the default transport.
+func (cb *configBuilder) WithResponseTimeout(timeout time.Duration) *configBuilder {
+	cb.responseTimeout = timeout
 	return cb
 }
 
-func (cb *configBuilder) WithZones(zone string) *configBuilder {
-	cb.optsScwReq = append(
-		cb.optsScwReq,
-		scw.WithZones([]scw.Zone{scw.Zone(zone)}...),
-	)
+// newTLSConfig returns the TLS settings for the S3 transport, or nil when the
+// defaults are fine. caCert is a PEM bundle appended to the system roots.
+func newTLSConfig(insecureSkipTLSVerify bool, caCert string) (*tls.Config, error) {
+	if !insecureSkipTLSVerify && caCert == "" {
+		return nil, nil
+	}
 
-	return cb
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecureSkipTLSVerify,
+	}
+
+	if caCert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(caCert)) {
+			return nil, errors.Errorf("could not parse %s: no valid PEM certificate found", caCertKey)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
 }
 
-func (cb *configBuilder) WithAuthRequest(accessKey, secretKey string) *configBuilder {
-	cb.optsScwReq = append(cb.optsScwReq, scw.WithAuthRequest(accessKey, secretKey))
+// WithRetryPolicy makes the S3 clients retry with the given policy.
+func (cb *configBuilder) WithRetryPolicy(policy *retryPolicy) *configBuilder {
+	cb.opts = append(cb.opts,
+		config.WithRetryer(policy.s3Retryer),
+		config.WithAPIOptions([]func(*middleware.Stack) error{policy.s3RetryMiddlewares}),
+	)
+	return cb
+}
 
+// WithRegion sets the region of the S3 clients, used to resolve the endpoint
+// and to sign the requests.
+func (cb *configBuilder) WithRegion(region string) *configBuilder {
+	if region != "" {
+		cb.opts = append(cb.opts, config.WithRegion(region))
+	}
 	return cb
 }
 
 func (cb *configBuilder) Build() (aws.Config, error) {
-	conf, err := config.LoadDefaultConfig(context.Background(), cb.opts...)
+	opts := cb.opts
+	if len(cb.transportOpts) > 0 || cb.responseTimeout > 0 {
+		opts = append(opts, config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(cb.transportOpts...)))
+	}
+	conf, err := config.LoadDefaultConfig(context.Background(), opts...)
 	if err != nil {
 		return aws.Config{}, err
 	}
+	// wrapped once loaded, as AWS_CA_BUNDLE requires a BuildableClient
+	if client, ok := conf.HTTPClient.(*awshttp.BuildableClient); ok && cb.responseTimeout > 0 {
+		conf.HTTPClient = &responseTimeoutClient{
+			bounded: client.WithTransportOptions(func(tr *http.Transport) {
+				tr.ResponseHeaderTimeout = cb.responseTimeout
+			}),
+			unbounded: client,
+		}
+	}
 	if cb.credsFlag {
 		if _, err := conf.Credentials.Retrieve(context.Background()); err != nil {
 			return aws.Config{}, errors.WithStack(err)
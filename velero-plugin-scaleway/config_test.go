@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCACertPEM(t *testing.T) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "velero-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		insecure      bool
+		caCert        string
+		expectNil     bool
+		expectRootCAs bool
+		expectedError string
+	}{
+		{
+			name:      "defaults keep the default transport",
+			expectNil: true,
+		},
+		{
+			name:     "insecure skip verify",
+			insecure: true,
+		},
+		{
+			name:          "valid CA bundle",
+			caCert:        testCACertPEM(t),
+			expectRootCAs: true,
+		},
+		{
+			name:          "invalid CA bundle",
+			caCert:        "not a certificate",
+			expectedError: "could not parse caCert: no valid PEM certificate found",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tlsConfig, err := newTLSConfig(tc.insecure, tc.caCert)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+
+			if tc.expectNil {
+				assert.Nil(t, tlsConfig)
+				return
+			}
+			require.NotNil(t, tlsConfig)
+			assert.Equal(t, tc.insecure, tlsConfig.InsecureSkipVerify)
+			assert.Equal(t, tc.expectRootCAs, tlsConfig.RootCAs != nil)
+		})
+	}
+}
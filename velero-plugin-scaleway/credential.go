@@ -1,14 +1,138 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/pkg/errors"
 	"github.com/scaleway/scaleway-sdk-go/scw"
+	"github.com/sirupsen/logrus"
 )
 
+const (
+	// defaultINIProfile is the profile read from AWS-style credentials files when
+	// no profile is configured.
+	defaultINIProfile = "default"
+	// defaultCredentialsDir is where Velero mounts its cloud-credentials Secret.
+	defaultCredentialsDir = "/credentials"
+	// veleroCredentialsFileName is the key of the default Velero cloud-credentials Secret.
+	veleroCredentialsFileName = "cloud"
+)
+
+// errCredentialsNotFound is returned by the providers of the chain that have
+// no credentials to offer, so the chain moves on to the next one.
+var errCredentialsNotFound = errors.New("credentials not found")
+
+// ScalewayCredentialsChain implements the CredentialsProvider interface on top
+// of an ordered list of providers. It is the single source of credentials of
+// both the object store and the volume snapshotter. The first provider
+// returning credentials wins, in the following order:
+// * the credentialsFile of the BSL/VSL
+// * the profile of the Scaleway config file
+// * the SCW_ACCESS_KEY and SCW_SECRET_KEY environment variables
+// * the mounted Secret directory
+//
+// File backed credentials are re-read when the file changes, so a rotated
+// Secret is picked up by the next request without restarting Velero.
+type ScalewayCredentialsChain struct {
+	log       logrus.FieldLogger
+	providers []aws.CredentialsProvider
+	// explicit is set when the user configured a credentials file, missing
+	// credentials are then reported at Init.
+	explicit bool
+
+	mu   sync.Mutex
+	last aws.Credentials
+}
+
+// NewScalewayCredentialsChain creates the credential chain for the given
+// credentials file, Scaleway config file profile and mounted Secret directory.
+// Empty values disable the matching provider, except for credentialsDir which
+// defaults to defaultCredentialsDir.
+func NewScalewayCredentialsChain(logger logrus.FieldLogger, credentialsFile, configPath, profileName, credentialsDir string) (*ScalewayCredentialsChain, error) {
+	chain := &ScalewayCredentialsChain{
+		log:      logger,
+		explicit: credentialsFile != "",
+	}
+
+	if credentialsFile != "" {
+		chain.providers = append(chain.providers, NewScalewayFileCredentialsProvider(credentialsFile, profileName))
+	}
+
+	// load the profile once to report an invalid config file at Init
+	profile, err := loadSCWConfigProfile(configPath, profileName)
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil {
+		if configPath == "" {
+			configPath = scw.GetConfigPath()
+		}
+		chain.providers = append(chain.providers, NewScalewayProfileCredentialsProvider(configPath, profileName))
+	}
+
+	if credentialsDir == "" {
+		credentialsDir = defaultCredentialsDir
+	}
+	chain.providers = append(chain.providers,
+		NewScalewayCredentialsProvider(scw.ScwAccessKeyEnv, scw.ScwSecretKeyEnv),
+		NewScalewaySecretDirCredentialsProvider(credentialsDir),
+	)
+
+	return chain, nil
+}
+
+// Retrieve returns the credentials of the first provider of the chain that has some.
+func (c *ScalewayCredentialsChain) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	var tried []string
+	for _, provider := range c.providers {
+		creds, err := provider.Retrieve(ctx)
+		if errors.Is(err, errCredentialsNotFound) {
+			tried = append(tried, err.Error())
+			continue
+		}
+		if err == nil {
+			c.observe(creds)
+		}
+		return creds, err
+	}
+	return aws.Credentials{}, errors.Errorf("no Scaleway credentials found: %s", strings.Join(tried, "; "))
+}
+
+// observe logs the credentials rotations.
+func (c *ScalewayCredentialsChain) observe(creds aws.Credentials) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.last.HasKeys() && (c.last.AccessKeyID != creds.AccessKeyID || c.last.SecretAccessKey != creds.SecretAccessKey) && c.log != nil {
+		c.log.WithFields(
+			logrus.Fields{
+				"source":            creds.Source,
+				"previousAccessKey": c.last.AccessKeyID,
+				"accessKey":         creds.AccessKeyID,
+			},
+		).Info("Scaleway credentials rotated")
+	}
+	c.last = creds
+}
+
+// ClientOption returns the Scaleway SDK option authenticating with the
+// credentials of the chain.
+func (c *ScalewayCredentialsChain) ClientOption(ctx context.Context) (scw.ClientOption, error) {
+	creds, err := c.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return scw.WithAuth(creds.AccessKeyID, creds.SecretAccessKey), nil
+}
+
 // ScalewayCredentialsProvider implements the CredentialsProvider interface
 type ScalewayCredentialsProvider struct {
 	accessKeyEnvVar string
@@ -29,29 +153,230 @@ func (scp *ScalewayCredentialsProvider) Retrieve(ctx context.Context) (aws.Crede
 	secretKey := os.Getenv(scp.secretKeyEnvVar)
 
 	if accessKey == "" || secretKey == "" {
-		return aws.Credentials{}, fmt.Errorf("credentials not available from environment variables")
+		return aws.Credentials{}, errors.Wrap(errCredentialsNotFound, "environment variables")
 	}
 
 	// Returning AWS-compatible credentials
 	return aws.Credentials{
 		AccessKeyID:     accessKey,
 		SecretAccessKey: secretKey,
+		Source:          "environment",
 		// AWS requires this for credentials validity tracking, so we can use `false` since
 		// Scaleway credentials don't expire in this way.
 		CanExpire: false,
 	}, nil
 }
 
-// WithCredentialsProvider takes an AWS-style credentials provider and returns an option function for loading credentials.
-func WithCredentialsProvider(v aws.CredentialsProvider) func(option *scw.ClientOption) error {
-	return func(o *scw.ClientOption) error {
-		// Use AWS credentials provider in the options (adjust this for your needs)
-		creds, err := v.Retrieve(context.Background())
+// ScalewayProfileCredentialsProvider implements the CredentialsProvider
+// interface for a profile of the Scaleway config file.
+type ScalewayProfileCredentialsProvider struct {
+	profileName string
+	file        watchedFile
+}
+
+// NewScalewayProfileCredentialsProvider creates a new ScalewayProfileCredentialsProvider
+func NewScalewayProfileCredentialsProvider(configPath, profileName string) *ScalewayProfileCredentialsProvider {
+	return &ScalewayProfileCredentialsProvider{
+		profileName: profileName,
+		file:        watchedFile{path: configPath},
+	}
+}
+
+// Retrieve retrieves the credentials from the Scaleway profile.
+func (p *ScalewayProfileCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	if _, err := os.Stat(p.file.path); os.IsNotExist(err) {
+		return aws.Credentials{}, errors.Wrap(errCredentialsNotFound, "scw profile")
+	}
+	return p.file.load(func() (aws.Credentials, error) {
+		profile, err := loadSCWConfigProfile(p.file.path, p.profileName)
+		if err != nil {
+			return aws.Credentials{}, err
+		}
+		if profile == nil || profile.AccessKey == nil || *profile.AccessKey == "" || profile.SecretKey == nil || *profile.SecretKey == "" {
+			return aws.Credentials{}, errors.Wrap(errCredentialsNotFound, "scw profile")
+		}
+		return fileCredentials(*profile.AccessKey, *profile.SecretKey, p.file.path), nil
+	})
+}
+
+// ScalewayFileCredentialsProvider implements the CredentialsProvider interface
+// for a credentials file, typically the per-location Secret mounted by Velero.
+type ScalewayFileCredentialsProvider struct {
+	profile string
+	file    watchedFile
+}
+
+// NewScalewayFileCredentialsProvider creates a new ScalewayFileCredentialsProvider
+func NewScalewayFileCredentialsProvider(path, profile string) *ScalewayFileCredentialsProvider {
+	return &ScalewayFileCredentialsProvider{
+		profile: profile,
+		file:    watchedFile{path: path},
+	}
+}
+
+// Retrieve retrieves the credentials from the credentials file.
+func (p *ScalewayFileCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	return p.file.load(func() (aws.Credentials, error) {
+		accessKey, secretKey, err := loadCredentialsFile(ctx, p.file.path, p.profile)
+		if err != nil {
+			return aws.Credentials{}, err
+		}
+		return fileCredentials(accessKey, secretKey, p.file.path), nil
+	})
+}
+
+// ScalewaySecretDirCredentialsProvider implements the CredentialsProvider
+// interface for a directory where a Kubernetes Secret is mounted. The Secret
+// either holds SCW_ACCESS_KEY and SCW_SECRET_KEY keys, or the cloud
+// credentials file of the default Velero install.
+type ScalewaySecretDirCredentialsProvider struct {
+	dir string
+	// Kubernetes swaps all the files of a Secret at once, so watching the
+	// secret key is enough to notice a rotation of both keys.
+	keyFiles  watchedFile
+	cloudFile *ScalewayFileCredentialsProvider
+}
+
+// NewScalewaySecretDirCredentialsProvider creates a new ScalewaySecretDirCredentialsProvider
+func NewScalewaySecretDirCredentialsProvider(dir string) *ScalewaySecretDirCredentialsProvider {
+	return &ScalewaySecretDirCredentialsProvider{
+		dir:       dir,
+		keyFiles:  watchedFile{path: filepath.Join(dir, scw.ScwSecretKeyEnv)},
+		cloudFile: NewScalewayFileCredentialsProvider(filepath.Join(dir, veleroCredentialsFileName), ""),
+	}
+}
+
+// Retrieve retrieves the credentials from the files of the Secret directory.
+func (p *ScalewaySecretDirCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	creds, err := p.keyFiles.load(func() (aws.Credentials, error) {
+		accessKey, err := os.ReadFile(filepath.Join(p.dir, scw.ScwAccessKeyEnv))
 		if err != nil {
-			return fmt.Errorf("failed to retrieve credentials: %w", err)
+			return aws.Credentials{}, err
+		}
+		secretKey, err := os.ReadFile(p.keyFiles.path)
+		if err != nil {
+			return aws.Credentials{}, err
+		}
+		return fileCredentials(strings.TrimSpace(string(accessKey)), strings.TrimSpace(string(secretKey)), p.dir), nil
+	})
+	if err == nil {
+		return creds, nil
+	}
+
+	if _, err := os.Stat(p.cloudFile.file.path); err != nil {
+		return aws.Credentials{}, errors.Wrapf(errCredentialsNotFound, "secret directory %s", p.dir)
+	}
+	return p.cloudFile.Retrieve(ctx)
+}
+
+// fileCredentials returns credentials read from a file. They are checked
+// again before every request, the watchedFile cache keeping that to a stat
+// call as long as the file does not change.
+func fileCredentials(accessKey, secretKey, source string) aws.Credentials {
+	return aws.Credentials{
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		Source:          source,
+		CanExpire:       true,
+		Expires:         time.Now(),
+	}
+}
+
+// watchedFile caches what was parsed from a file until its modification time
+// or its size changes.
+type watchedFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	creds   aws.Credentials
+	err     error
+}
+
+// load returns the cached result of parse, calling it again if the file changed.
+func (w *watchedFile) load(parse func() (aws.Credentials, error)) (aws.Credentials, error) {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return aws.Credentials{}, errors.Wrapf(err, "could not stat %s", w.path)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.modTime.IsZero() || !info.ModTime().Equal(w.modTime) || info.Size() != w.size {
+		w.creds, w.err = parse()
+		w.modTime = info.ModTime()
+		w.size = info.Size()
+	}
+	if w.err != nil {
+		return aws.Credentials{}, w.err
+	}
+
+	creds := w.creds
+	creds.Expires = time.Now()
+	return creds, nil
+}
+
+// loadCredentialsFile reads an access key and a secret key from either an
+// AWS-style INI credentials file or a Scaleway config.yaml file.
+func loadCredentialsFile(ctx context.Context, path, profile string) (string, string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "could not read %s: %s", credentialsFileKey, path)
+	}
+
+	var accessKey, secretKey string
+	if isINICredentials(content) {
+		if profile == "" {
+			profile = defaultINIProfile
+		}
+		sharedConfig, err := config.LoadSharedConfigProfile(ctx, profile, func(o *config.LoadSharedConfigOptions) {
+			o.CredentialsFiles = []string{path}
+			o.ConfigFiles = []string{}
+		})
+		if err != nil {
+			return "", "", errors.Wrapf(err, "could not load profile %q from %s", profile, path)
+		}
+		accessKey = sharedConfig.Credentials.AccessKeyID
+		secretKey = sharedConfig.Credentials.SecretAccessKey
+	} else {
+		scwConfig, err := scw.LoadConfigFromPath(path)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "could not load %s: %s", credentialsFileKey, path)
+		}
+		var scwProfile *scw.Profile
+		if profile == "" {
+			scwProfile, err = scwConfig.GetActiveProfile()
+		} else {
+			scwProfile, err = scwConfig.GetProfile(profile)
+		}
+		if err != nil {
+			return "", "", errors.Wrapf(err, "could not load profile %q from %s", profile, path)
+		}
+		if scwProfile.AccessKey != nil {
+			accessKey = *scwProfile.AccessKey
+		}
+		if scwProfile.SecretKey != nil {
+			secretKey = *scwProfile.SecretKey
+		}
+	}
+
+	if accessKey == "" || secretKey == "" {
+		return "", "", errors.Errorf("credentials not available from %s", path)
+	}
+	return accessKey, secretKey, nil
+}
+
+// isINICredentials tells an AWS-style credentials file, which starts with a
+// [profile] section, from a Scaleway YAML config file.
+func isINICredentials(content []byte) bool {
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
 		}
-		// Use the credentials for Scaleway client options
-		*o = scw.WithAuth(creds.AccessKeyID, creds.SecretAccessKey)
-		return nil
+		return line[0] == '['
 	}
+	return false
 }
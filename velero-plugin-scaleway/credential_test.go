@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/scaleway/scaleway-sdk-go/scw"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testAccessKey       = "SCWXXXXXXXXXXXXXXXXX"
+	testSecretKey       = "11111111-1111-1111-1111-111111111111"
+	testOtherAccessKey  = "SCWYYYYYYYYYYYYYYYYY"
+	testOtherSecretKey  = "22222222-2222-2222-2222-222222222222"
+	testINICredentials  = "[default]\naws_access_key_id = " + testAccessKey + "\naws_secret_access_key = " + testSecretKey + "\n\n[other]\naws_access_key_id = " + testOtherAccessKey + "\naws_secret_access_key = " + testOtherSecretKey + "\n"
+	testYAMLCredentials = "access_key: " + testAccessKey + "\nsecret_key: " + testSecretKey + "\nprofiles:\n  other:\n    access_key: " + testOtherAccessKey + "\n    secret_key: " + testOtherSecretKey + "\n"
+)
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestFileCredentialsProvider(t *testing.T) {
+	tests := []struct {
+		name              string
+		content           string
+		profile           string
+		expectedAccessKey string
+		expectedSecretKey string
+		expectedError     bool
+	}{
+		{
+			name:              "ini default profile",
+			content:           testINICredentials,
+			expectedAccessKey: testAccessKey,
+			expectedSecretKey: testSecretKey,
+		},
+		{
+			name:              "ini named profile",
+			content:           "# velero credentials\n" + testINICredentials,
+			profile:           "other",
+			expectedAccessKey: testOtherAccessKey,
+			expectedSecretKey: testOtherSecretKey,
+		},
+		{
+			name:              "scw config default profile",
+			content:           testYAMLCredentials,
+			expectedAccessKey: testAccessKey,
+			expectedSecretKey: testSecretKey,
+		},
+		{
+			name:              "scw config named profile",
+			content:           testYAMLCredentials,
+			profile:           "other",
+			expectedAccessKey: testOtherAccessKey,
+			expectedSecretKey: testOtherSecretKey,
+		},
+		{
+			name:          "unknown profile",
+			content:       testYAMLCredentials,
+			profile:       "missing",
+			expectedError: true,
+		},
+		{
+			name:          "missing secret key",
+			content:       "[default]\naws_access_key_id = " + testAccessKey + "\n",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeTestFile(t, "credentials", tc.content)
+
+			creds, err := NewScalewayFileCredentialsProvider(path, tc.profile).Retrieve(context.Background())
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedAccessKey, creds.AccessKeyID)
+			assert.Equal(t, tc.expectedSecretKey, creds.SecretAccessKey)
+		})
+	}
+}
+
+func TestFileCredentialsProviderMissingFile(t *testing.T) {
+	_, err := NewScalewayFileCredentialsProvider(filepath.Join(t.TempDir(), "missing"), "").Retrieve(context.Background())
+	assert.Error(t, err)
+}
+
+func TestSecretDirCredentialsProvider(t *testing.T) {
+	t.Run("key files", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "SCW_ACCESS_KEY"), []byte(testAccessKey+"\n"), 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "SCW_SECRET_KEY"), []byte(testSecretKey+"\n"), 0o600))
+
+		creds, err := NewScalewaySecretDirCredentialsProvider(dir).Retrieve(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, testAccessKey, creds.AccessKeyID)
+		assert.Equal(t, testSecretKey, creds.SecretAccessKey)
+	})
+
+	t.Run("velero cloud file", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "cloud"), []byte(testINICredentials), 0o600))
+
+		creds, err := NewScalewaySecretDirCredentialsProvider(dir).Retrieve(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, testAccessKey, creds.AccessKeyID)
+	})
+
+	t.Run("empty directory", func(t *testing.T) {
+		_, err := NewScalewaySecretDirCredentialsProvider(t.TempDir()).Retrieve(context.Background())
+		assert.ErrorIs(t, err, errCredentialsNotFound)
+	})
+}
+
+func TestCredentialsChainPrecedence(t *testing.T) {
+	const (
+		fileAccessKey    = "SCWFILEXXXXXXXXXXXXX"
+		profileAccessKey = "SCWPROFILEXXXXXXXXXX"
+		envAccessKey     = "SCWENVXXXXXXXXXXXXXX"
+		dirAccessKey     = "SCWDIRXXXXXXXXXXXXXX"
+	)
+
+	credentialsFile := writeTestFile(t, "credentials", "[default]\naws_access_key_id = "+fileAccessKey+"\naws_secret_access_key = "+testSecretKey+"\n")
+	configPath := writeTestFile(t, "config.yaml", "access_key: "+profileAccessKey+"\nsecret_key: "+testSecretKey+"\n")
+	credentialsDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(credentialsDir, "SCW_ACCESS_KEY"), []byte(dirAccessKey), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(credentialsDir, "SCW_SECRET_KEY"), []byte(testSecretKey), 0o600))
+
+	tests := []struct {
+		name              string
+		credentialsFile   string
+		configPath        string
+		env               bool
+		credentialsDir    string
+		expectedAccessKey string
+		expectedError     bool
+	}{
+		{
+			name:              "credentials file first",
+			credentialsFile:   credentialsFile,
+			configPath:        configPath,
+			env:               true,
+			credentialsDir:    credentialsDir,
+			expectedAccessKey: fileAccessKey,
+		},
+		{
+			name:              "then the scw profile",
+			configPath:        configPath,
+			env:               true,
+			credentialsDir:    credentialsDir,
+			expectedAccessKey: profileAccessKey,
+		},
+		{
+			name:              "then the environment",
+			configPath:        filepath.Join(t.TempDir(), "missing.yaml"),
+			env:               true,
+			credentialsDir:    credentialsDir,
+			expectedAccessKey: envAccessKey,
+		},
+		{
+			name:              "then the secret directory",
+			configPath:        filepath.Join(t.TempDir(), "missing.yaml"),
+			credentialsDir:    credentialsDir,
+			expectedAccessKey: dirAccessKey,
+		},
+		{
+			name:           "nothing configured",
+			configPath:     filepath.Join(t.TempDir(), "missing.yaml"),
+			credentialsDir: t.TempDir(),
+			expectedError:  true,
+		},
+		{
+			name:            "a broken credentials file does not fall through",
+			credentialsFile: filepath.Join(t.TempDir(), "missing"),
+			env:             true,
+			credentialsDir:  credentialsDir,
+			expectedError:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			unsetSCWEnv(t)
+			if tc.env {
+				t.Setenv("SCW_ACCESS_KEY", envAccessKey)
+				t.Setenv("SCW_SECRET_KEY", testSecretKey)
+			}
+
+			chain, err := NewScalewayCredentialsChain(newLogger(), tc.credentialsFile, tc.configPath, "", tc.credentialsDir)
+			require.NoError(t, err)
+
+			creds, err := chain.Retrieve(context.Background())
+			if tc.expectedError {
+				assert.Error(t, err)
+				_, err = chain.ClientOption(context.Background())
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedAccessKey, creds.AccessKeyID)
+
+			opt, err := chain.ClientOption(context.Background())
+			require.NoError(t, err)
+			client, err := scw.NewClient(opt)
+			require.NoError(t, err)
+			accessKey, _ := client.GetAccessKey()
+			assert.Equal(t, tc.expectedAccessKey, accessKey)
+		})
+	}
+}
+
+// rotateTestFile rewrites a credentials file and moves its modification time
+// forward, like kubelet does when a Secret is updated.
+func rotateTestFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+}
+
+func TestCredentialsChainReloadsRotatedFile(t *testing.T) {
+	unsetSCWEnv(t)
+
+	logger, hook := logrustest.NewNullLogger()
+	credentialsFile := writeTestFile(t, "credentials", testINICredentials)
+	chain, err := NewScalewayCredentialsChain(logger, credentialsFile, filepath.Join(t.TempDir(), "missing.yaml"), "", t.TempDir())
+	require.NoError(t, err)
+
+	// the S3 client goes through the same cache as with LoadDefaultConfig
+	cache := aws.NewCredentialsCache(chain)
+
+	creds, err := cache.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, testAccessKey, creds.AccessKeyID)
+	assert.Empty(t, hook.AllEntries())
+
+	rotateTestFile(t, credentialsFile, "[default]\naws_access_key_id = "+testOtherAccessKey+"\naws_secret_access_key = "+testOtherSecretKey+"\n")
+
+	creds, err = cache.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, testOtherAccessKey, creds.AccessKeyID)
+	assert.Equal(t, testOtherSecretKey, creds.SecretAccessKey)
+
+	require.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, "Scaleway credentials rotated", hook.LastEntry().Message)
+	assert.Equal(t, testOtherAccessKey, hook.LastEntry().Data["accessKey"])
+}
+
+func TestClientReloaderFollowsRotation(t *testing.T) {
+	unsetSCWEnv(t)
+	t.Setenv(scw.ScwDefaultOrganizationIDEnv, "33333333-3333-3333-3333-333333333333")
+	t.Setenv(scw.ScwDefaultZoneEnv, "fr-par-1")
+	t.Setenv(scw.ScwDefaultRegionEnv, "fr-par")
+
+	credentialsFile := writeTestFile(t, "credentials", testINICredentials)
+	chain, err := NewScalewayCredentialsChain(newLogger(), credentialsFile, filepath.Join(t.TempDir(), "missing.yaml"), "", t.TempDir())
+	require.NoError(t, err)
+
+	reloader, err := newClientBuilder(newLogger()).WithEnvProfile().WithCredentialsChain(chain).BuildReloading("", "")
+	require.NoError(t, err)
+
+	before, err := reloader.Client(context.Background())
+	require.NoError(t, err)
+	accessKey, _ := before.GetAccessKey()
+	assert.Equal(t, testAccessKey, accessKey)
+
+	same, err := reloader.Client(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, before, same)
+
+	rotateTestFile(t, credentialsFile, "[default]\naws_access_key_id = "+testOtherAccessKey+"\naws_secret_access_key = "+testOtherSecretKey+"\n")
+
+	after, err := reloader.Client(context.Background())
+	require.NoError(t, err)
+	accessKey, _ = after.GetAccessKey()
+	assert.Equal(t, testOtherAccessKey, accessKey)
+
+	// the previous client, possibly used by requests in flight, keeps its key
+	accessKey, _ = before.GetAccessKey()
+	assert.Equal(t, testAccessKey, accessKey)
+}
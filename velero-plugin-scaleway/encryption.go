@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	encryptionKeyFileKey = "encryptionKeyFile"
+
+	// encryptionAlgorithm streams the data through AES-256-GCM in chunks, see encryptReader.
+	encryptionAlgorithm = "AES256-GCM-CHUNKED"
+	encryptionChunkSize = 64 * 1024
+	// maxEncryptionChunkSize bounds the buffers allocated to decrypt an object.
+	maxEncryptionChunkSize = 16 * 1024 * 1024
+	dataKeySize            = 32
+	chunkNoncePrefixLen    = 8
+
+	// the metadata of encrypted objects, stored as x-amz-meta-* headers.
+	encryptionAlgMetadataKey      = "cse-algorithm"
+	encryptionChunkMetadataKey    = "cse-chunk-size"
+	encryptionNonceMetadataKey    = "cse-nonce"
+	encryptionProviderMetadataKey = "cse-key-provider"
+	encryptionKeyIDMetadataKey    = "cse-key-id"
+	encryptionKeyVerMetadataKey   = "cse-key-version"
+	encryptionKeyMetadataKey      = "cse-key"
+
+	fileKeyProvider = "file"
+)
+
+// keyWrapper protects the data keys of encrypted objects with a master key
+// that never leaves the plugin or the key provider.
+type keyWrapper interface {
+	// provider identifies the wrapper in the object metadata.
+	provider() string
+	// wrapKey encrypts dataKey with the active master key.
+	wrapKey(ctx context.Context, dataKey []byte) (wrappedKey, error)
+	// unwrapKey decrypts a data key wrapped by wrapKey.
+	unwrapKey(ctx context.Context, key wrappedKey) ([]byte, error)
+}
+
+// wrappedKey is a data key encrypted by a master key, as stored in the object metadata.
+type wrappedKey struct {
+	data  []byte
+	keyID string
+	// version is the version of the master key, when the provider rotates keys.
+	version string
+}
+
+// fileKeyWrapper wraps data keys with the master keys of a mounted key file.
+// The file holds one keyID=base64 key per line, the first key wrapping the
+// new data keys while the others are kept to read older objects.
+type fileKeyWrapper struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+func newFileKeyWrapper(path string) (*fileKeyWrapper, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read %s: %s", encryptionKeyFileKey, path)
+	}
+	defer file.Close()
+
+	w := &fileKeyWrapper{keys: map[string][]byte{}}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, "=")
+		if !ok || id == "" {
+			return nil, errors.Errorf("invalid %s %s, line %d: expected keyID=base64 key", encryptionKeyFileKey, path, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != dataKeySize {
+			return nil, errors.Errorf("invalid %s %s, line %d: key %s is not a base64 encoded 32 bytes key", encryptionKeyFileKey, path, line, id)
+		}
+		if _, ok := w.keys[id]; ok {
+			return nil, errors.Errorf("invalid %s %s, line %d: duplicate key %s", encryptionKeyFileKey, path, line, id)
+		}
+		if w.activeID == "" {
+			w.activeID = id
+		}
+		w.keys[id] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "could not read %s: %s", encryptionKeyFileKey, path)
+	}
+	if w.activeID == "" {
+		return nil, errors.Errorf("invalid %s %s: no key found", encryptionKeyFileKey, path)
+	}
+	return w, nil
+}
+
+func (w *fileKeyWrapper) provider() string {
+	return fileKeyProvider
+}
+
+// wrapKey seals dataKey with AES-256-GCM, the key ID being authenticated
+// along with it. The wrapped key is the nonce followed by the sealed key.
+func (w *fileKeyWrapper) wrapKey(_ context.Context, dataKey []byte) (wrappedKey, error) {
+	aead, err := newGCM(w.keys[w.activeID])
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return wrappedKey{}, errors.WithStack(err)
+	}
+	return wrappedKey{
+		data:  aead.Seal(nonce, nonce, dataKey, []byte(w.activeID)),
+		keyID: w.activeID,
+	}, nil
+}
+
+func (w *fileKeyWrapper) unwrapKey(_ context.Context, wrapped wrappedKey) ([]byte, error) {
+	keyID := wrapped.keyID
+	key, ok := w.keys[keyID]
+	if !ok {
+		return nil, errors.Errorf("master key %s is not in %s", keyID, encryptionKeyFileKey)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped.data) < aead.NonceSize() {
+		return nil, errors.New("wrapped data key is too short")
+	}
+	dataKey, err := aead.Open(nil, wrapped.data[:aead.NonceSize()], wrapped.data[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not unwrap data key with master key %s", keyID)
+	}
+	return dataKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aead, nil
+}
+
+// encryptBody returns body encrypted with a new data key, and the metadata
+// to store with the object to decrypt it.
+func encryptBody(ctx context.Context, wrapper keyWrapper, body io.Reader) (io.Reader, map[string]string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	noncePrefix := make([]byte, chunkNoncePrefixLen)
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	wrapped, err := wrapper.wrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not wrap data key")
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata := map[string]string{
+		encryptionAlgMetadataKey:      encryptionAlgorithm,
+		encryptionChunkMetadataKey:    strconv.Itoa(encryptionChunkSize),
+		encryptionNonceMetadataKey:    base64.StdEncoding.EncodeToString(noncePrefix),
+		encryptionProviderMetadataKey: wrapper.provider(),
+		encryptionKeyIDMetadataKey:    wrapped.keyID,
+		encryptionKeyMetadataKey:      base64.StdEncoding.EncodeToString(wrapped.data),
+	}
+	if wrapped.version != "" {
+		metadata[encryptionKeyVerMetadataKey] = wrapped.version
+	}
+	return newEncryptReader(body, aead, noncePrefix, encryptionChunkSize), metadata, nil
+}
+
+// isEncrypted tells whether the metadata of an object describes an encrypted object.
+func isEncrypted(metadata map[string]string) bool {
+	_, ok := metadata[encryptionAlgMetadataKey]
+	return ok
+}
+
+// decryptBody returns the plaintext of an encrypted object body.
+func decryptBody(ctx context.Context, wrapper keyWrapper, body io.ReadCloser, metadata map[string]string) (io.ReadCloser, error) {
+	if alg := metadata[encryptionAlgMetadataKey]; alg != encryptionAlgorithm {
+		return nil, errors.Errorf("unsupported encryption algorithm %q", alg)
+	}
+	if wrapper == nil {
+		return nil, errors.Errorf("object is encrypted but neither %s nor %s is set", encryptionKeyFileKey, kmsKeyIDKey)
+	}
+	if provider := metadata[encryptionProviderMetadataKey]; provider != wrapper.provider() {
+		return nil, errors.Errorf("object data key was wrapped by %q, the configured key provider is %q", provider, wrapper.provider())
+	}
+
+	chunkSize, err := strconv.Atoi(metadata[encryptionChunkMetadataKey])
+	if err != nil || chunkSize < 1 || chunkSize > maxEncryptionChunkSize {
+		return nil, errors.Errorf("invalid encryption chunk size %q", metadata[encryptionChunkMetadataKey])
+	}
+	noncePrefix, err := base64.StdEncoding.DecodeString(metadata[encryptionNonceMetadataKey])
+	if err != nil || len(noncePrefix) != chunkNoncePrefixLen {
+		return nil, errors.New("invalid encryption nonce")
+	}
+	wrapped := wrappedKey{
+		keyID:   metadata[encryptionKeyIDMetadataKey],
+		version: metadata[encryptionKeyVerMetadataKey],
+	}
+	if wrapped.data, err = base64.StdEncoding.DecodeString(metadata[encryptionKeyMetadataKey]); err != nil {
+		return nil, errors.Wrap(err, "invalid wrapped data key")
+	}
+
+	dataKey, err := wrapper.unwrapKey(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptReader(body, aead, noncePrefix, chunkSize), nil
+}
+
+// chunkNonce returns the nonce of a chunk: the random prefix of the object
+// followed by the index of the chunk.
+func chunkNonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, chunkNoncePrefixLen+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[chunkNoncePrefixLen:], index)
+	return nonce
+}
+
+// chunkAAD authenticates whether a chunk is the last one, so a truncated
+// object does not decrypt.
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// readChunk reads up to len(buf) bytes and tells whether the source is drained.
+func readChunk(r *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return n, true, nil
+	case err != nil:
+		return n, false, err
+	}
+	if _, err := r.Peek(1); err == io.EOF {
+		return n, true, nil
+	} else if err != nil {
+		return n, false, err
+	}
+	return n, false, nil
+}
+
+// encryptReader encrypts a stream in chunks sealed with AES-256-GCM. An
+// object always has at least one chunk, the last one being flagged.
+type encryptReader struct {
+	src         *bufio.Reader
+	aead        cipher.AEAD
+	noncePrefix []byte
+	index       uint32
+	plain       []byte
+	buf         []byte
+	out         []byte
+	final       bool
+}
+
+func newEncryptReader(src io.Reader, aead cipher.AEAD, noncePrefix []byte, chunkSize int) *encryptReader {
+	return &encryptReader{
+		src:         bufio.NewReader(src),
+		aead:        aead,
+		noncePrefix: noncePrefix,
+		plain:       make([]byte, chunkSize),
+		buf:         make([]byte, 0, chunkSize+aead.Overhead()),
+	}
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.final {
+			return 0, io.EOF
+		}
+		n, final, err := readChunk(r.src, r.plain)
+		if err != nil {
+			return 0, err
+		}
+		r.final = final
+		r.out = r.aead.Seal(r.buf[:0], chunkNonce(r.noncePrefix, r.index), r.plain[:n], chunkAAD(final))
+		r.index++
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// decryptReader decrypts a stream produced by encryptReader. An altered or
+// truncated object fails with an error instead of a short read.
+type decryptReader struct {
+	body        io.ReadCloser
+	src         *bufio.Reader
+	aead        cipher.AEAD
+	noncePrefix []byte
+	index       uint32
+	sealed      []byte
+	buf         []byte
+	out         []byte
+	final       bool
+}
+
+func newDecryptReader(body io.ReadCloser, aead cipher.AEAD, noncePrefix []byte, chunkSize int) *decryptReader {
+	return &decryptReader{
+		body:        body,
+		src:         bufio.NewReader(body),
+		aead:        aead,
+		noncePrefix: noncePrefix,
+		sealed:      make([]byte, chunkSize+aead.Overhead()),
+		buf:         make([]byte, 0, chunkSize),
+	}
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.final {
+			return 0, io.EOF
+		}
+		n, final, err := readChunk(r.src, r.sealed)
+		if err != nil {
+			return 0, err
+		}
+		r.out, err = r.aead.Open(r.buf[:0], chunkNonce(r.noncePrefix, r.index), r.sealed[:n], chunkAAD(final))
+		if err != nil {
+			return 0, errors.Errorf("could not decrypt chunk %d: the object is corrupted or truncated", r.index)
+		}
+		r.final = final
+		r.index++
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyFile(t *testing.T, ids ...string) string {
+	var content bytes.Buffer
+	content.WriteString("# master keys, the first one is active\n")
+	for _, id := range ids {
+		key := make([]byte, dataKeySize)
+		_, err := rand.Read(key)
+		require.NoError(t, err)
+		content.WriteString(id + "=" + base64.StdEncoding.EncodeToString(key) + "\n")
+	}
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, content.Bytes(), 0600))
+	return path
+}
+
+func TestNewFileKeyWrapper(t *testing.T) {
+	w, err := newFileKeyWrapper(writeKeyFile(t, "2024-02", "2024-01"))
+	require.NoError(t, err)
+	assert.Equal(t, "2024-02", w.activeID)
+	assert.Len(t, w.keys, 2)
+
+	for name, content := range map[string]string{
+		"empty":     "# no key\n",
+		"no id":     "=" + base64.StdEncoding.EncodeToString(make([]byte, dataKeySize)),
+		"short key": "k1=" + base64.StdEncoding.EncodeToString(make([]byte, 16)),
+		"duplicate": "k1=" + base64.StdEncoding.EncodeToString(make([]byte, dataKeySize)) + "\nk1=" + base64.StdEncoding.EncodeToString(make([]byte, dataKeySize)),
+	} {
+		path := filepath.Join(t.TempDir(), "keys")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		_, err := newFileKeyWrapper(path)
+		assert.Error(t, err, name)
+	}
+
+	_, err = newFileKeyWrapper(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	w, err := newFileKeyWrapper(writeKeyFile(t, "k1"))
+	require.NoError(t, err)
+
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3*encryptionChunkSize + 5} {
+		plaintext := make([]byte, size)
+		_, err := rand.Read(plaintext)
+		require.NoError(t, err)
+
+		encrypted, metadata, err := encryptBody(context.Background(), w, bytes.NewReader(plaintext))
+		require.NoError(t, err)
+		ciphertext, err := io.ReadAll(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "k1", metadata[encryptionKeyIDMetadataKey])
+		assert.True(t, isEncrypted(metadata))
+
+		decrypted, err := decryptBody(context.Background(), w, io.NopCloser(bytes.NewReader(ciphertext)), metadata)
+		require.NoError(t, err)
+		data, err := io.ReadAll(decrypted)
+		require.NoError(t, err, "size %d", size)
+		assert.Equal(t, plaintext, data, "size %d", size)
+	}
+}
+
+func TestDecryptWithRotatedKey(t *testing.T) {
+	path := writeKeyFile(t, "old")
+	old, err := newFileKeyWrapper(path)
+	require.NoError(t, err)
+
+	encrypted, metadata, err := encryptBody(context.Background(), old, bytes.NewReader([]byte("backup")))
+	require.NoError(t, err)
+	ciphertext, err := io.ReadAll(encrypted)
+	require.NoError(t, err)
+
+	// a new active key is prepended, the old one still decrypts older objects
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	rotated := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(rotated, append([]byte("new="+base64.StdEncoding.EncodeToString(make([]byte, dataKeySize))+"\n"), content...), 0600))
+	w, err := newFileKeyWrapper(rotated)
+	require.NoError(t, err)
+	assert.Equal(t, "new", w.activeID)
+
+	decrypted, err := decryptBody(context.Background(), w, io.NopCloser(bytes.NewReader(ciphertext)), metadata)
+	require.NoError(t, err)
+	data, err := io.ReadAll(decrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "backup", string(data))
+}
+
+func TestDecryptDetectsCorruption(t *testing.T) {
+	w, err := newFileKeyWrapper(writeKeyFile(t, "k1"))
+	require.NoError(t, err)
+
+	encrypted, metadata, err := encryptBody(context.Background(), w, bytes.NewReader(make([]byte, 2*encryptionChunkSize+10)))
+	require.NoError(t, err)
+	ciphertext, err := io.ReadAll(encrypted)
+	require.NoError(t, err)
+
+	tampered := bytes.Clone(ciphertext)
+	tampered[10] ^= 1
+	truncated := ciphertext[:2*(encryptionChunkSize+16)]
+
+	for name, body := range map[string][]byte{"tampered": tampered, "truncated": truncated} {
+		decrypted, err := decryptBody(context.Background(), w, io.NopCloser(bytes.NewReader(body)), metadata)
+		require.NoError(t, err)
+		_, err = io.ReadAll(decrypted)
+		assert.ErrorContains(t, err, "the object is corrupted or truncated", name)
+	}
+}
+
+func TestGetObjectDecrypts(t *testing.T) {
+	w, err := newFileKeyWrapper(writeKeyFile(t, "k1"))
+	require.NoError(t, err)
+
+	encrypted, metadata, err := encryptBody(context.Background(), w, bytes.NewReader([]byte("backup")))
+	require.NoError(t, err)
+	ciphertext, err := io.ReadAll(encrypted)
+	require.NoError(t, err)
+
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	s.On("GetObject", mock.Anything, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("encrypted")}).Return(&s3.GetObjectOutput{
+		Body:     io.NopCloser(bytes.NewReader(ciphertext)),
+		Metadata: metadata,
+	}, nil)
+	s.On("GetObject", mock.Anything, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("legacy")}).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("legacy backup"))),
+	}, nil)
+
+	o := &ObjectStore{
+		log:        newLogger(),
+		s3:         s,
+		keyWrapper: w,
+	}
+
+	for key, expected := range map[string]string{"encrypted": "backup", "legacy": "legacy backup"} {
+		body, err := o.GetObject("b", key)
+		require.NoError(t, err)
+		data, err := io.ReadAll(body)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+		require.NoError(t, body.Close())
+	}
+
+	// an encrypted object cannot be read without the master keys
+	o.keyWrapper = nil
+	_, err = o.GetObject("b", "encrypted")
+	assert.ErrorContains(t, err, "object is encrypted but neither encryptionKeyFile nor kmsKeyId is set")
+}
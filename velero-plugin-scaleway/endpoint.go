@@ -1,57 +1,155 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"os"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	smithyauth "github.com/aws/smithy-go/auth"
+	smithyendpoints "github.com/aws/smithy-go/endpoints"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/pkg/errors"
+	"github.com/scaleway/scaleway-sdk-go/scw"
 )
 
-// ScalewayEndpointResolver implements the EndpointResolverWithOptions interface for Scaleway.
-type ScalewayEndpointResolver struct {
-	// Add fields for configuration if needed.
-	urlEnvVar string
-	region    string
-}
+// s3EndpointEnvVar overrides the Scaleway Object Storage endpoint when s3Url is not set.
+const s3EndpointEnvVar = "SCW_S3_ENDPOINT"
+
+// scwEndpointHostRegex matches the hosts of the Scaleway Object Storage
+// endpoints, with or without a virtual-hosted bucket.
+var scwEndpointHostRegex = regexp.MustCompile(`(?:^|\.)s3\.([a-z]+-[a-z]+)\.scw\.cloud$`)
+
+// bucketDNSLabelRegex matches the bucket names usable as a single DNS label
+// of a virtual-hosted endpoint.
+var bucketDNSLabelRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// ScalewayEndpointResolver implements the s3.EndpointResolverV2 interface for
+// Scaleway Object Storage. The region of the client is used both to build the
+// endpoint URL and as the signing region.
+type ScalewayEndpointResolver struct{}
 
 // NewScalewayEndpointResolver initializes a new ScalewayEndpointResolver.
-func NewScalewayEndpointResolver(urlEnvVar, regionEnvVar string) *ScalewayEndpointResolver {
-	return &ScalewayEndpointResolver{
-		urlEnvVar: urlEnvVar,
-		region:    regionEnvVar,
-	}
+func NewScalewayEndpointResolver() *ScalewayEndpointResolver {
+	return &ScalewayEndpointResolver{}
 }
 
-// ResolveEndpoint resolves the endpoint for a Scaleway service in a given region.
-func (r *ScalewayEndpointResolver) ResolveEndpoint(service, region string, options ...interface{}) (aws.Endpoint, error) {
-	// Define available regions for Scaleway
-	validRegions := map[string]bool{
-		"fr-par": true, // Paris, France
-		"nl-ams": true, // Amsterdam, Netherlands
-		"pl-waw": true, // Warsaw, Poland
+// ResolveEndpoint resolves the endpoint of an S3 request.
+func (r *ScalewayEndpointResolver) ResolveEndpoint(ctx context.Context, params s3.EndpointParameters) (smithyendpoints.Endpoint, error) {
+	var region, customURL string
+	if params.Region != nil {
+		region = *params.Region
+	}
+	if params.Endpoint != nil {
+		customURL = *params.Endpoint
 	}
 
-	// Check if the region is valid.
-	if !validRegions[region] {
-		return aws.Endpoint{}, fmt.Errorf("region %s is not supported for Scaleway", region)
+	region, err := endpointRegion(region, customURL)
+	if err != nil {
+		return smithyendpoints.Endpoint{}, err
 	}
 
-	var url string
-	switch service {
-	case "s3":
-		customEndpoint := os.Getenv(r.urlEnvVar)
-		if customEndpoint != "" {
-			url = customEndpoint // Use the custom endpoint if it's set.
+	endpoint := customURL
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.scw.cloud", region)
+	}
+	uri, err := url.Parse(endpoint)
+	if err != nil {
+		return smithyendpoints.Endpoint{}, errors.Wrapf(err, "invalid s3 endpoint %s", endpoint)
+	}
+
+	if params.Bucket != nil && *params.Bucket != "" {
+		bucket := *params.Bucket
+		forcePathStyle := params.ForcePathStyle != nil && *params.ForcePathStyle
+		// buckets with dots are not covered by the wildcard certificate of the endpoint
+		if !forcePathStyle && isVirtualHostable(uri) && bucketDNSLabelRegex.MatchString(bucket) {
+			uri.Host = bucket + "." + uri.Host
 		} else {
-			// Fallback to default S3 endpoint format.
-			url = fmt.Sprintf("https://s3.%s.scw.cloud", region)
+			uri.Path = strings.TrimSuffix(uri.Path, "/") + "/" + bucket
 		}
-	default:
-		return aws.Endpoint{}, fmt.Errorf("service %s is not supported", service)
 	}
 
-	// Return the constructed endpoint.
-	return aws.Endpoint{
-		URL:           url,
-		SigningRegion: region,
+	var sp smithy.Properties
+	smithyhttp.SetSigV4SigningName(&sp, "s3")
+	smithyhttp.SetSigV4SigningRegion(&sp, region)
+	smithyhttp.SetDisableDoubleEncoding(&sp, true)
+
+	var props smithy.Properties
+	smithyauth.SetAuthOptions(&props, []*smithyauth.Option{
+		{
+			SchemeID:         "aws.auth#sigv4",
+			SignerProperties: sp,
+		},
+	})
+
+	return smithyendpoints.Endpoint{
+		URI:        *uri,
+		Properties: props,
 	}, nil
 }
+
+// isVirtualHostable tells whether buckets can be addressed as a subdomain of
+// the endpoint. Only the Scaleway endpoints are known to serve them: IP
+// addresses, single-label hosts or hosts with a port, as used by MinIO and
+// other on-premises endpoints, are addressed with path-style URLs.
+func isVirtualHostable(uri *url.URL) bool {
+	if uri.Port() != "" {
+		return false
+	}
+	match := scwEndpointHostRegex.FindString(uri.Hostname())
+	return match != "" && match == uri.Hostname()
+}
+
+// endpointRegion returns the signing region of an endpoint. The region is
+// checked against the Scaleway regions when the endpoint is a Scaleway one, and
+// must match the region of a Scaleway endpoint URL. Other S3 compatible
+// endpoints accept any region.
+func endpointRegion(region, customURL string) (string, error) {
+	if customURL == "" {
+		if region == "" {
+			return "", errors.Errorf("a region is required to resolve the Scaleway Object Storage endpoint, available regions are: %s", scwRegionNames())
+		}
+		if !isSCWRegion(region) {
+			return "", errors.Errorf("region %s is not supported by Scaleway Object Storage, available regions are: %s", region, scwRegionNames())
+		}
+		return region, nil
+	}
+
+	uri, err := url.Parse(customURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid s3 endpoint %s", customURL)
+	}
+	match := scwEndpointHostRegex.FindStringSubmatch(uri.Hostname())
+	switch {
+	case match == nil && region == "":
+		// S3 compatible endpoints without regions usually expect the AWS default one
+		return "us-east-1", nil
+	case match == nil:
+		return region, nil
+	case !isSCWRegion(match[1]):
+		return "", errors.Errorf("endpoint %s targets region %s which is not supported by Scaleway Object Storage, available regions are: %s", customURL, match[1], scwRegionNames())
+	case region != "" && region != match[1]:
+		return "", errors.Errorf("region %s does not match the region %s of endpoint %s", region, match[1], customURL)
+	}
+	return match[1], nil
+}
+
+func isSCWRegion(region string) bool {
+	for _, r := range scw.AllRegions {
+		if string(r) == region {
+			return true
+		}
+	}
+	return false
+}
+
+func scwRegionNames() string {
+	regions := []string(nil)
+	for _, r := range scw.AllRegions {
+		regions = append(regions, string(r))
+	}
+	return strings.Join(regions, ", ")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyauth "github.com/aws/smithy-go/auth"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScalewayEndpointResolver(t *testing.T) {
+	tests := []struct {
+		name           string
+		params         s3.EndpointParameters
+		expectedURL    string
+		expectedRegion string
+		expectedError  string
+	}{
+		{
+			name:           "virtual-hosted bucket",
+			params:         s3.EndpointParameters{Region: aws.String("fr-par"), Bucket: aws.String("velero")},
+			expectedURL:    "https://velero.s3.fr-par.scw.cloud",
+			expectedRegion: "fr-par",
+		},
+		{
+			name:           "path-style bucket",
+			params:         s3.EndpointParameters{Region: aws.String("nl-ams"), Bucket: aws.String("velero"), ForcePathStyle: aws.Bool(true)},
+			expectedURL:    "https://s3.nl-ams.scw.cloud/velero",
+			expectedRegion: "nl-ams",
+		},
+		{
+			name:           "bucket with dots falls back to path-style",
+			params:         s3.EndpointParameters{Region: aws.String("pl-waw"), Bucket: aws.String("velero.backups")},
+			expectedURL:    "https://s3.pl-waw.scw.cloud/velero.backups",
+			expectedRegion: "pl-waw",
+		},
+		{
+			name:           "custom endpoint",
+			params:         s3.EndpointParameters{Region: aws.String("minio"), Endpoint: aws.String("http://minio:9000"), Bucket: aws.String("velero"), ForcePathStyle: aws.Bool(true)},
+			expectedURL:    "http://minio:9000/velero",
+			expectedRegion: "minio",
+		},
+		{
+			name:           "custom endpoint without s3ForcePathStyle",
+			params:         s3.EndpointParameters{Endpoint: aws.String("https://s3.example.com"), Bucket: aws.String("velero")},
+			expectedURL:    "https://s3.example.com/velero",
+			expectedRegion: "us-east-1",
+		},
+		{
+			name:           "IP endpoint",
+			params:         s3.EndpointParameters{Endpoint: aws.String("http://10.0.0.5:9000"), Bucket: aws.String("velero")},
+			expectedURL:    "http://10.0.0.5:9000/velero",
+			expectedRegion: "us-east-1",
+		},
+		{
+			name:           "single-label endpoint",
+			params:         s3.EndpointParameters{Region: aws.String("minio"), Endpoint: aws.String("http://minio:9000"), Bucket: aws.String("velero")},
+			expectedURL:    "http://minio:9000/velero",
+			expectedRegion: "minio",
+		},
+		{
+			name:           "virtual-hosted bucket on a Scaleway endpoint",
+			params:         s3.EndpointParameters{Endpoint: aws.String("https://s3.nl-ams.scw.cloud"), Bucket: aws.String("velero")},
+			expectedURL:    "https://velero.s3.nl-ams.scw.cloud",
+			expectedRegion: "nl-ams",
+		},
+		{
+			name:           "Scaleway endpoint with a port",
+			params:         s3.EndpointParameters{Endpoint: aws.String("https://s3.nl-ams.scw.cloud:443"), Bucket: aws.String("velero")},
+			expectedURL:    "https://s3.nl-ams.scw.cloud:443/velero",
+			expectedRegion: "nl-ams",
+		},
+		{
+			name:           "region taken from a Scaleway endpoint",
+			params:         s3.EndpointParameters{Endpoint: aws.String("https://s3.nl-ams.scw.cloud")},
+			expectedURL:    "https://s3.nl-ams.scw.cloud",
+			expectedRegion: "nl-ams",
+		},
+		{
+			name:          "mismatched region and endpoint",
+			params:        s3.EndpointParameters{Region: aws.String("fr-par"), Endpoint: aws.String("https://s3.nl-ams.scw.cloud")},
+			expectedError: "region fr-par does not match the region nl-ams of endpoint https://s3.nl-ams.scw.cloud",
+		},
+		{
+			name:          "unsupported region",
+			params:        s3.EndpointParameters{Region: aws.String("us-east-1")},
+			expectedError: "region us-east-1 is not supported by Scaleway Object Storage, available regions are: " + scwRegionNames(),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoint, err := NewScalewayEndpointResolver().ResolveEndpoint(context.Background(), tc.params)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedURL, endpoint.URI.String())
+
+			opts, ok := smithyauth.GetAuthOptions(&endpoint.Properties)
+			require.True(t, ok)
+			require.Len(t, opts, 1)
+			region, _ := smithyhttp.GetSigV4SigningRegion(&opts[0].SignerProperties)
+			assert.Equal(t, tc.expectedRegion, region)
+		})
+	}
+}
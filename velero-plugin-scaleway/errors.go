@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"time"
+
 	"github.com/scaleway/scaleway-sdk-go/scw"
 )
 
@@ -34,3 +36,67 @@ More info: https://github.com/scaleway/scaleway-sdk-go/tree/master/scw#scaleway-
 		varEnv,
 	)
 }
+
+// TimeoutError is returned when a call to Scaleway does not complete in time.
+type TimeoutError struct {
+	// Op is the name of the operation, e.g. GetObject.
+	Op string
+	// Elapsed is the time spent in the operation.
+	Elapsed time.Duration
+	// Idle is set when the deadline between two reads of a streamed body expired.
+	Idle bool
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Idle {
+		return fmt.Sprintf("%s timed out after %s: no data transferred for longer than the idle timeout", e.Op, e.Elapsed.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("%s timed out after %s", e.Op, e.Elapsed.Round(time.Millisecond))
+}
+
+// ObjectLockedError is returned when an object cannot be deleted because it is
+// under Object Lock retention.
+type ObjectLockedError struct {
+	Key string
+	// VersionID is the locked version, empty for the current version.
+	VersionID string
+	// Mode is the retention mode of the object, GOVERNANCE or COMPLIANCE.
+	Mode        string
+	RetainUntil time.Time
+}
+
+func (e *ObjectLockedError) Error() string {
+	if e.VersionID != "" {
+		return fmt.Sprintf("version %s of object %s is retained until %s (%s mode)", e.VersionID, e.Key, e.RetainUntil.UTC().Format(time.RFC3339), e.Mode)
+	}
+	return fmt.Sprintf("object %s is retained until %s (%s mode)", e.Key, e.RetainUntil.UTC().Format(time.RFC3339), e.Mode)
+}
+
+// ObjectRestoreInProgressError is returned when reading an archived object
+// whose restore was requested but is not completed yet. Reading the object
+// again once it is restored succeeds.
+type ObjectRestoreInProgressError struct {
+	Key string
+	// Waited is the time spent waiting for the restore.
+	Waited time.Duration
+}
+
+func (e *ObjectRestoreInProgressError) Error() string {
+	if e.Waited > 0 {
+		return fmt.Sprintf("object %s is archived, its restore is still in progress after %s: retry once it is restored", e.Key, e.Waited.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("object %s is archived, its restore was requested: retry once it is restored", e.Key)
+}
+
+// ChecksumMismatchError is returned at the end of a download whose checksum
+// does not match the checksum stored with the object.
+type ChecksumMismatchError struct {
+	Key       string
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("integrity check of object %s failed: expected %s checksum %s, got %s", e.Key, e.Algorithm, e.Expected, e.Actual)
+}
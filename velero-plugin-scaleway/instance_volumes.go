@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/scaleway/scaleway-sdk-go/api/instance/v1"
+	"github.com/scaleway/scaleway-sdk-go/scw"
+	"github.com/scaleway/scaleway-sdk-go/validation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	instanceCSIDriver = "csi.scaleway.com"
+
+	// instanceIDPrefix tells the Instance volumes and snapshots apart in the
+	// IDs stored by Velero.
+	instanceIDPrefix = "instance:"
+)
+
+// instanceInterface is the part of the Instance API used by VolumeSnapshotter.
+type instanceInterface interface {
+	GetVolume(req *instance.GetVolumeRequest, opts ...scw.RequestOption) (*instance.GetVolumeResponse, error)
+	CreateVolume(req *instance.CreateVolumeRequest, opts ...scw.RequestOption) (*instance.CreateVolumeResponse, error)
+	DeleteVolume(req *instance.DeleteVolumeRequest, opts ...scw.RequestOption) error
+	GetSnapshot(req *instance.GetSnapshotRequest, opts ...scw.RequestOption) (*instance.GetSnapshotResponse, error)
+	CreateSnapshot(req *instance.CreateSnapshotRequest, opts ...scw.RequestOption) (*instance.CreateSnapshotResponse, error)
+	DeleteSnapshot(req *instance.DeleteSnapshotRequest, opts ...scw.RequestOption) error
+}
+
+// instanceVolumes snapshots and restores the b_ssd volumes of the legacy
+// csi.scaleway.com driver, which are managed by the Instance API.
+type instanceVolumes struct {
+	s *VolumeSnapshotter
+}
+
+func (v *instanceVolumes) idPrefix() string {
+	return instanceIDPrefix
+}
+
+// createVolumeFromSnapshot restores a snapshot to a new volume of the type of
+// the snapshot, in the zone of the snapshot. Instance volumes have no IOPS, so
+// requested IOPS are not applied. It returns once the volume is available,
+// deleting the volume when it does not become available.
+func (v *instanceVolumes) createVolumeFromSnapshot(snapshotID zonedID, volumeAZ string, iops uint32) (zonedID, error) {
+	if iops > 0 {
+		v.s.log.WithFields(
+			logrus.Fields{
+				"snapshot": snapshotID,
+				"iops":     iops,
+			},
+		).Warn("Instance volumes have no IOPS, restoring the volume without them")
+	}
+
+	instanceAPI, err := v.s.instanceAPI()
+	if err != nil {
+		return zonedID{}, err
+	}
+
+	// describe the snapshot, so we can apply its tags to the volume
+	var snapshot *instance.Snapshot
+	zone, err := v.s.callInZone("GetSnapshot", true, snapshotID, scw.Zone(volumeAZ), func(zone scw.Zone, opt scw.RequestOption) error {
+		resp, err := instanceAPI.GetSnapshot(&instance.GetSnapshotRequest{
+			Zone:       zone,
+			SnapshotID: snapshotID.id,
+		}, opt)
+		if err != nil {
+			return err
+		}
+		snapshot = resp.Snapshot
+		return nil
+	})
+	if err != nil {
+		return zonedID{}, errors.Wrapf(err, "error getting snapshot %s", snapshotID)
+	}
+	if snapshot == nil {
+		return zonedID{}, errors.Errorf("expected snapshot from GetSnapshot for %s", snapshotID)
+	}
+	if snapshot.State != instance.SnapshotStateAvailable {
+		return zonedID{}, errors.Errorf("snapshot %s is %s, expected %s", snapshotID, snapshot.State, instance.SnapshotStateAvailable)
+	}
+	if validation.IsZone(volumeAZ) && scw.Zone(volumeAZ) != zone {
+		return zonedID{}, errors.Errorf("snapshot %s is in zone %s, it cannot be restored in zone %s", snapshotID, zone, volumeAZ)
+	}
+
+	// the volume gets the size of the snapshot
+	input := &instance.CreateVolumeRequest{
+		Zone:         zone,
+		Name:         fmt.Sprintf("restore-%s", snapshot.Name),
+		VolumeType:   snapshot.VolumeType,
+		BaseSnapshot: scw.StringPtr(snapshotID.id),
+	}
+	if len(snapshot.Tags) > 0 {
+		input.Tags = getTagsForCluster(snapshot.Tags)
+	}
+
+	var volume *instance.Volume
+	err = v.s.call("CreateVolume", false, func(opt scw.RequestOption) error {
+		resp, err := instanceAPI.CreateVolume(input, opt)
+		if err != nil {
+			return err
+		}
+		volume = resp.Volume
+		return nil
+	})
+	if err != nil {
+		return zonedID{}, errors.Wrapf(err, "error creating volume from snapshot %s", snapshotID)
+	}
+
+	volumeID := zonedID{zone: volume.Zone, id: volume.ID}
+	err = v.s.waitForStatus("GetVolume", "volume", volumeID, v.s.volumeTimeout, instance.VolumeStateAvailable.String(), instance.VolumeStateError.String(), func(opt scw.RequestOption) (string, error) {
+		resp, err := instanceAPI.GetVolume(&instance.GetVolumeRequest{
+			Zone:     volumeID.zone,
+			VolumeID: volumeID.id,
+		}, opt)
+		if err != nil {
+			return "", err
+		}
+		return resp.Volume.State.String(), nil
+	})
+	if err != nil {
+		// Velero does not know about the volume of a failed restore
+		deleteErr := v.s.call("DeleteVolume", true, func(opt scw.RequestOption) error {
+			return instanceAPI.DeleteVolume(&instance.DeleteVolumeRequest{
+				Zone:     volumeID.zone,
+				VolumeID: volumeID.id,
+			}, opt)
+		})
+		if deleteErr != nil && !isNotFound(deleteErr) {
+			v.s.log.WithError(deleteErr).WithField("volume", volumeID).Warn("Failed to delete the volume")
+		}
+		return zonedID{}, err
+	}
+
+	return volumeID, nil
+}
+
+// getVolumeInfo returns the type of a volume. Instance volumes have no IOPS.
+func (v *instanceVolumes) getVolumeInfo(volumeID zonedID, hint scw.Zone) (string, *int64, error) {
+	volume, err := v.describeVolume(volumeID, hint)
+	if err != nil {
+		return "", nil, err
+	}
+	return volume.VolumeType.String(), nil, nil
+}
+
+func (v *instanceVolumes) describeVolume(volumeID zonedID, hint scw.Zone) (*instance.Volume, error) {
+	instanceAPI, err := v.s.instanceAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	var volume *instance.Volume
+	_, err = v.s.callInZone("GetVolume", true, volumeID, hint, func(zone scw.Zone, opt scw.RequestOption) error {
+		resp, err := instanceAPI.GetVolume(&instance.GetVolumeRequest{
+			Zone:     zone,
+			VolumeID: volumeID.id,
+		}, opt)
+		if err != nil {
+			return err
+		}
+		volume = resp.Volume
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting volume %s", volumeID)
+	}
+	if volume == nil {
+		return nil, errors.Errorf("expected volume from GetVolume for %s", volumeID)
+	}
+	return volume, nil
+}
+
+// createSnapshot snapshots a volume, returning once the snapshot is available.
+func (v *instanceVolumes) createSnapshot(volumeID zonedID, snapshotName string, tags []string) (zonedID, error) {
+	// describe the volume, so we can copy its tags to the snapshot
+	volume, err := v.describeVolume(volumeID, "")
+	if err != nil {
+		return zonedID{}, err
+	}
+
+	instanceAPI, err := v.s.instanceAPI()
+	if err != nil {
+		return zonedID{}, err
+	}
+
+	tagsMerged := toTags(volume.Tags).merge(tags)
+	input := &instance.CreateSnapshotRequest{
+		Zone:     volume.Zone,
+		Name:     fmt.Sprintf("vol-%s-snap-%s", volume.Name, snapshotName),
+		VolumeID: scw.StringPtr(volume.ID),
+		Tags:     &tagsMerged,
+	}
+
+	var snapshot *instance.Snapshot
+	err = v.s.call("CreateSnapshot", false, func(opt scw.RequestOption) error {
+		resp, err := instanceAPI.CreateSnapshot(input, opt)
+		if err != nil {
+			return err
+		}
+		snapshot = resp.Snapshot
+		return nil
+	})
+	if err != nil {
+		return zonedID{}, errors.Wrapf(err, "error creating snapshot of volume %s", volumeID)
+	}
+
+	snapshotID := zonedID{zone: snapshot.Zone, id: snapshot.ID}
+	err = v.s.waitForStatus("GetSnapshot", "snapshot", snapshotID, v.s.snapshotTimeout, instance.SnapshotStateAvailable.String(), instance.SnapshotStateError.String(), func(opt scw.RequestOption) (string, error) {
+		resp, err := instanceAPI.GetSnapshot(&instance.GetSnapshotRequest{
+			Zone:       snapshotID.zone,
+			SnapshotID: snapshotID.id,
+		}, opt)
+		if err != nil {
+			return "", err
+		}
+		return resp.Snapshot.State.String(), nil
+	})
+	if err != nil {
+		// Velero does not know about the snapshot of a failed backup
+		if deleteErr := v.deleteSnapshot(snapshotID); deleteErr != nil {
+			v.s.log.WithError(deleteErr).WithField("snapshot", snapshotID).Warn("Failed to delete the snapshot")
+		}
+		return zonedID{}, err
+	}
+
+	return snapshotID, nil
+}
+
+func (v *instanceVolumes) deleteSnapshot(snapshotID zonedID) error {
+	instanceAPI, err := v.s.instanceAPI()
+	if err != nil {
+		return err
+	}
+
+	_, err = v.s.callInZone("DeleteSnapshot", true, snapshotID, "", func(zone scw.Zone, opt scw.RequestOption) error {
+		return instanceAPI.DeleteSnapshot(&instance.DeleteSnapshotRequest{
+			Zone:       zone,
+			SnapshotID: snapshotID.id,
+		}, opt)
+	})
+	// the snapshot is already gone
+	if isNotFound(err) {
+		return nil
+	}
+	return errors.WithStack(err)
+}
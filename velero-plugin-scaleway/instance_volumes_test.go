@@ -0,0 +1,197 @@
+package main
+
+import (
+	"testing"
+
+	block "github.com/scaleway/scaleway-sdk-go/api/block/v1alpha1"
+	"github.com/scaleway/scaleway-sdk-go/api/instance/v1"
+	"github.com/scaleway/scaleway-sdk-go/scw"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type mockInstance struct {
+	mock.Mock
+}
+
+func (m *mockInstance) GetVolume(req *instance.GetVolumeRequest, opts ...scw.RequestOption) (*instance.GetVolumeResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*instance.GetVolumeResponse), args.Error(1)
+}
+
+func (m *mockInstance) CreateVolume(req *instance.CreateVolumeRequest, opts ...scw.RequestOption) (*instance.CreateVolumeResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*instance.CreateVolumeResponse), args.Error(1)
+}
+
+func (m *mockInstance) DeleteVolume(req *instance.DeleteVolumeRequest, opts ...scw.RequestOption) error {
+	args := m.Called(req)
+	return args.Error(0)
+}
+
+func (m *mockInstance) GetSnapshot(req *instance.GetSnapshotRequest, opts ...scw.RequestOption) (*instance.GetSnapshotResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*instance.GetSnapshotResponse), args.Error(1)
+}
+
+func (m *mockInstance) CreateSnapshot(req *instance.CreateSnapshotRequest, opts ...scw.RequestOption) (*instance.CreateSnapshotResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*instance.CreateSnapshotResponse), args.Error(1)
+}
+
+func (m *mockInstance) DeleteSnapshot(req *instance.DeleteSnapshotRequest, opts ...scw.RequestOption) error {
+	args := m.Called(req)
+	return args.Error(0)
+}
+
+func newTestInstanceVolumeSnapshotter(i *mockInstance) *VolumeSnapshotter {
+	s := newTestVolumeSnapshotter(new(mockBlock))
+	s.instance = i
+	return s
+}
+
+func TestInstanceGetVolumeInfo(t *testing.T) {
+	i := new(mockInstance)
+	defer i.AssertExpectations(t)
+
+	i.On("GetVolume", &instance.GetVolumeRequest{Zone: scw.ZoneFrPar2, VolumeID: testVolumeID}).Return(&instance.GetVolumeResponse{
+		Volume: &instance.Volume{ID: testVolumeID, Zone: scw.ZoneFrPar2, VolumeType: instance.VolumeVolumeTypeBSSD},
+	}, nil).Once()
+
+	volumeType, iops, err := newTestInstanceVolumeSnapshotter(i).GetVolumeInfo("instance:fr-par-2/"+testVolumeID, "fr-par-2")
+	require.NoError(t, err)
+	assert.Equal(t, "b_ssd", volumeType)
+	assert.Nil(t, iops)
+}
+
+func TestInstanceCreateSnapshot(t *testing.T) {
+	i := new(mockInstance)
+	defer i.AssertExpectations(t)
+
+	i.On("GetVolume", &instance.GetVolumeRequest{Zone: scw.ZoneFrPar1, VolumeID: testVolumeID}).Return(&instance.GetVolumeResponse{
+		Volume: &instance.Volume{ID: testVolumeID, Name: "pvc-1", Zone: scw.ZoneFrPar1, Tags: []string{"cluster"}},
+	}, nil).Once()
+	i.On("CreateSnapshot", &instance.CreateSnapshotRequest{
+		Zone:     scw.ZoneFrPar1,
+		Name:     "vol-pvc-1-snap-backup",
+		VolumeID: scw.StringPtr(testVolumeID),
+		Tags:     &[]string{"cluster", "velero"},
+	}).Return(&instance.CreateSnapshotResponse{
+		Snapshot: &instance.Snapshot{ID: testSnapshotID, Zone: scw.ZoneFrPar1, State: instance.SnapshotStateSnapshotting},
+	}, nil).Once()
+	getSnapshot := &instance.GetSnapshotRequest{Zone: scw.ZoneFrPar1, SnapshotID: testSnapshotID}
+	i.On("GetSnapshot", getSnapshot).Return(&instance.GetSnapshotResponse{
+		Snapshot: &instance.Snapshot{State: instance.SnapshotStateSnapshotting},
+	}, nil).Once()
+	i.On("GetSnapshot", getSnapshot).Return(&instance.GetSnapshotResponse{
+		Snapshot: &instance.Snapshot{State: instance.SnapshotStateAvailable},
+	}, nil).Once()
+
+	snapshotID, err := newTestInstanceVolumeSnapshotter(i).CreateSnapshot("instance:fr-par-1/"+testVolumeID, "backup", []string{"velero"})
+	require.NoError(t, err)
+	assert.Equal(t, "instance:fr-par-1/"+testSnapshotID, snapshotID)
+}
+
+func TestInstanceCreateVolumeFromSnapshot(t *testing.T) {
+	const restoredVolumeID = "33333333-3333-3333-3333-333333333333"
+
+	tests := []struct {
+		name          string
+		iops          uint32
+		volumeState   instance.VolumeState
+		expected      string
+		expectedError string
+	}{
+		{
+			name:        "volume available",
+			volumeState: instance.VolumeStateAvailable,
+			expected:    "instance:fr-par-1/" + restoredVolumeID,
+		},
+		{
+			// b_ssd volumes have no IOPS, the volume is restored with a warning
+			name:        "IOPS requested",
+			iops:        5000,
+			volumeState: instance.VolumeStateAvailable,
+			expected:    "instance:fr-par-1/" + restoredVolumeID,
+		},
+		{
+			name:          "volume in error",
+			volumeState:   instance.VolumeStateError,
+			expectedError: "volume fr-par-1/" + restoredVolumeID + " failed",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			i := new(mockInstance)
+			defer i.AssertExpectations(t)
+
+			i.On("GetSnapshot", &instance.GetSnapshotRequest{Zone: scw.ZoneFrPar1, SnapshotID: testSnapshotID}).Return(&instance.GetSnapshotResponse{
+				Snapshot: &instance.Snapshot{
+					ID:         testSnapshotID,
+					Name:       "vol-pvc-1-snap-backup",
+					Zone:       scw.ZoneFrPar1,
+					State:      instance.SnapshotStateAvailable,
+					VolumeType: instance.VolumeVolumeTypeBSSD,
+				},
+			}, nil).Once()
+			i.On("CreateVolume", &instance.CreateVolumeRequest{
+				Zone:         scw.ZoneFrPar1,
+				Name:         "restore-vol-pvc-1-snap-backup",
+				VolumeType:   instance.VolumeVolumeTypeBSSD,
+				BaseSnapshot: scw.StringPtr(testSnapshotID),
+			}).Return(&instance.CreateVolumeResponse{
+				Volume: &instance.Volume{ID: restoredVolumeID, Zone: scw.ZoneFrPar1},
+			}, nil).Once()
+			i.On("GetVolume", &instance.GetVolumeRequest{Zone: scw.ZoneFrPar1, VolumeID: restoredVolumeID}).Return(&instance.GetVolumeResponse{
+				Volume: &instance.Volume{State: tc.volumeState},
+			}, nil).Once()
+			if tc.expectedError != "" {
+				// the volume is unknown to Velero, so it is removed
+				i.On("DeleteVolume", &instance.DeleteVolumeRequest{Zone: scw.ZoneFrPar1, VolumeID: restoredVolumeID}).Return(nil).Once()
+			}
+
+			logger, hook := logrustest.NewNullLogger()
+			s := newTestInstanceVolumeSnapshotter(i)
+			s.log = logger
+
+			volumeID, err := s.CreateVolumeFromSnapshot("instance:fr-par-1/"+testSnapshotID, "fr-par-1", tc.iops)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, volumeID)
+
+			var warnings []string
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == logrus.WarnLevel {
+					warnings = append(warnings, entry.Message)
+				}
+			}
+			if tc.iops > 0 {
+				assert.Equal(t, []string{"Instance volumes have no IOPS, restoring the volume without them"}, warnings)
+			} else {
+				assert.Empty(t, warnings)
+			}
+		})
+	}
+}
+
+func TestDeleteSnapshotsOfBothDrivers(t *testing.T) {
+	b := new(mockBlock)
+	defer b.AssertExpectations(t)
+	i := new(mockInstance)
+	defer i.AssertExpectations(t)
+
+	b.On("DeleteSnapshot", &block.DeleteSnapshotRequest{Zone: scw.ZoneFrPar1, SnapshotID: testSnapshotID}).Return(nil).Once()
+	i.On("DeleteSnapshot", &instance.DeleteSnapshotRequest{Zone: scw.ZoneFrPar2, SnapshotID: testSnapshotID}).Return(nil).Once()
+
+	s := newTestVolumeSnapshotter(b)
+	s.instance = i
+	require.NoError(t, s.DeleteSnapshot("fr-par-1/"+testSnapshotID))
+	require.NoError(t, s.DeleteSnapshot("instance:fr-par-2/"+testSnapshotID))
+}
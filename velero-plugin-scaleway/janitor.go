@@ -0,0 +1,203 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	multipartUploadMaxAgeKey        = "multipartUploadMaxAge"
+	multipartJanitorIntervalKey     = "multipartJanitorInterval"
+	defaultMultipartUploadMaxAge    = 0
+	defaultMultipartJanitorInterval = 0
+	// minMultipartUploadMaxAge keeps the janitor away from the uploads in
+	// progress, the multipart upload of a large backup taking minutes.
+	minMultipartUploadMaxAge = time.Hour
+)
+
+// multipartJanitor aborts the multipart uploads left under the prefix of a
+// BSL by Velero pods that crashed during an upload, as Scaleway bills their
+// parts as storage.
+type multipartJanitor struct {
+	endpoint string
+	region   string
+	bucket   string
+	prefix   string
+	// credentials are the settings the credentials of the BSL are read from.
+	credentials credentialsSettings
+	// maxAge is the age after which an incomplete upload is considered orphaned,
+	// zero disabling the janitor.
+	maxAge time.Duration
+	// interval is the period of the janitor, zero meaning it only runs at Init.
+	interval time.Duration
+}
+
+// credentialsSettings are the BSL keys of NewScalewayCredentialsChain.
+type credentialsSettings struct {
+	file       string
+	configPath string
+	profile    string
+	dir        string
+}
+
+// parseMultipartJanitor reads the janitor settings from the BSL config. The
+// maximum age must exceed the upload timeout, so the janitor never aborts an
+// upload in progress.
+func parseMultipartJanitor(config map[string]string, uploadTimeout time.Duration) (multipartJanitor, error) {
+	janitor := multipartJanitor{
+		bucket: config[bucketKey],
+		prefix: config[prefixKey],
+	}
+
+	var err error
+	if janitor.maxAge, err = parseTimeout(config, multipartUploadMaxAgeKey, defaultMultipartUploadMaxAge); err != nil {
+		return multipartJanitor{}, err
+	}
+	if janitor.interval, err = parseTimeout(config, multipartJanitorIntervalKey, defaultMultipartJanitorInterval); err != nil {
+		return multipartJanitor{}, err
+	}
+	if janitor.interval > 0 && janitor.maxAge == 0 {
+		return multipartJanitor{}, errors.Errorf("%s requires %s to be set", multipartJanitorIntervalKey, multipartUploadMaxAgeKey)
+	}
+	if janitor.maxAge > 0 && janitor.maxAge < max(minMultipartUploadMaxAge, uploadTimeout) {
+		return multipartJanitor{}, errors.Errorf("%s must be at least %s and the %s, got %s", multipartUploadMaxAgeKey, minMultipartUploadMaxAge, uploadTimeoutKey, janitor.maxAge)
+	}
+	return janitor, nil
+}
+
+// janitorKey identifies the location swept by a janitor.
+type janitorKey struct {
+	endpoint string
+	region   string
+	bucket   string
+	prefix   string
+}
+
+func (j multipartJanitor) key() janitorKey {
+	return janitorKey{endpoint: j.endpoint, region: j.region, bucket: j.bucket, prefix: j.prefix}
+}
+
+// runningJanitor is a janitor started by an Init, closing stop stops it.
+type runningJanitor struct {
+	janitor multipartJanitor
+	stop    chan struct{}
+}
+
+// multipartJanitors are the janitors running in the process, one per location,
+// as Velero calls Init on every new plugin instance.
+var multipartJanitors = struct {
+	sync.Mutex
+	running map[janitorKey]runningJanitor
+}{running: map[janitorKey]runningJanitor{}}
+
+// startMultipartJanitor starts the janitor of a location unless the process
+// already runs it with the same settings. The janitor of a location whose
+// settings changed is restarted, and the one of a location where it was
+// turned off is stopped. The janitor sweeps the location in the background,
+// once, then on its interval until it is stopped.
+func (o *ObjectStore) startMultipartJanitor(janitor multipartJanitor) {
+	key := janitor.key()
+	multipartJanitors.Lock()
+	defer multipartJanitors.Unlock()
+
+	running, ok := multipartJanitors.running[key]
+	if ok && running.janitor == janitor {
+		return
+	}
+	if ok {
+		o.log.WithFields(
+			logrus.Fields{
+				"bucket": janitor.bucket,
+				"prefix": janitor.prefix,
+			},
+		).Info("Restarting the multipart upload janitor with new settings")
+		close(running.stop)
+		delete(multipartJanitors.running, key)
+	}
+	if janitor.maxAge == 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	multipartJanitors.running[key] = runningJanitor{janitor: janitor, stop: stop}
+	go o.runMultipartJanitor(janitor, stop)
+}
+
+// stopMultipartJanitor stops the janitor of a location, the next Init on the
+// location starting a new one.
+func stopMultipartJanitor(key janitorKey) {
+	multipartJanitors.Lock()
+	defer multipartJanitors.Unlock()
+	if running, ok := multipartJanitors.running[key]; ok {
+		close(running.stop)
+		delete(multipartJanitors.running, key)
+	}
+}
+
+func (o *ObjectStore) runMultipartJanitor(janitor multipartJanitor, stop <-chan struct{}) {
+	o.abortOrphanedMultipartUploads(janitor, time.Now())
+	if janitor.interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(janitor.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			o.abortOrphanedMultipartUploads(janitor, now)
+		}
+	}
+}
+
+// abortOrphanedMultipartUploads aborts the multipart uploads under the prefix
+// of the janitor that were initiated more than maxAge before now. Failures are
+// logged only, the next run picks up the uploads left behind.
+func (o *ObjectStore) abortOrphanedMultipartUploads(janitor multipartJanitor, now time.Time) {
+	log := o.log.WithFields(
+		logrus.Fields{
+			"bucket": janitor.bucket,
+			"prefix": janitor.prefix,
+		},
+	)
+
+	op := newOperation("ListMultipartUploads", o.listTimeout)
+	defer op.done()
+
+	var orphaned, aborted int
+	p := s3.NewListMultipartUploadsPaginator(o.s3, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(janitor.bucket),
+		Prefix: aws.String(janitor.prefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(op.ctx)
+		if err != nil {
+			log.WithError(op.wrap(err)).Error("Failed to list multipart uploads")
+			return
+		}
+		for _, upload := range page.Uploads {
+			if upload.Initiated == nil || now.Sub(*upload.Initiated) < janitor.maxAge {
+				continue
+			}
+			orphaned++
+			if o.abortMultipartUpload(janitor.bucket, aws.ToString(upload.Key), aws.ToString(upload.UploadId)) {
+				aborted++
+			}
+		}
+	}
+	if orphaned > 0 {
+		log.WithFields(
+			logrus.Fields{
+				"orphaned": orphaned,
+				"aborted":  aborted,
+			},
+		).Info("Cleaned up orphaned multipart uploads")
+	}
+}
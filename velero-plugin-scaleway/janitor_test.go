@@ -0,0 +1,187 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMultipartJanitor(t *testing.T) {
+	janitor, err := parseMultipartJanitor(map[string]string{bucketKey: "b", prefixKey: "velero"}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, multipartJanitor{bucket: "b", prefix: "velero"}, janitor)
+
+	janitor, err = parseMultipartJanitor(map[string]string{
+		bucketKey:                   "b",
+		multipartUploadMaxAgeKey:    "24h",
+		multipartJanitorIntervalKey: "1h",
+	}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, multipartJanitor{bucket: "b", maxAge: 24 * time.Hour, interval: time.Hour}, janitor)
+
+	_, err = parseMultipartJanitor(map[string]string{multipartJanitorIntervalKey: "1h"}, 0)
+	assert.EqualError(t, err, "multipartJanitorInterval requires multipartUploadMaxAge to be set")
+
+	_, err = parseMultipartJanitor(map[string]string{multipartUploadMaxAgeKey: "-1h"}, 0)
+	assert.Error(t, err)
+
+	// the janitor would abort the uploads in progress
+	_, err = parseMultipartJanitor(map[string]string{multipartUploadMaxAgeKey: "10m"}, 0)
+	assert.EqualError(t, err, "multipartUploadMaxAge must be at least 1h0m0s and the uploadTimeout, got 10m0s")
+	_, err = parseMultipartJanitor(map[string]string{multipartUploadMaxAgeKey: "2h"}, 3*time.Hour)
+	assert.EqualError(t, err, "multipartUploadMaxAge must be at least 1h0m0s and the uploadTimeout, got 2h0m0s")
+}
+
+func TestAbortOrphanedMultipartUploads(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	o := &ObjectStore{
+		log: newLogger(),
+		s3:  s,
+	}
+
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	janitor := multipartJanitor{bucket: "b", prefix: "velero/", maxAge: 24 * time.Hour}
+
+	s.On("ListMultipartUploads", mock.Anything, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String("b"),
+		Prefix: aws.String("velero/"),
+	}).Return(&s3.ListMultipartUploadsOutput{
+		IsTruncated:        aws.Bool(true),
+		NextKeyMarker:      aws.String("velero/backups/b2/b2.tar.gz"),
+		NextUploadIdMarker: aws.String("upload-2"),
+		Uploads: []types.MultipartUpload{
+			{Key: aws.String("velero/backups/b1/b1.tar.gz"), UploadId: aws.String("upload-1"), Initiated: aws.Time(now.Add(-48 * time.Hour))},
+			{Key: aws.String("velero/backups/b2/b2.tar.gz"), UploadId: aws.String("upload-2"), Initiated: aws.Time(now.Add(-time.Hour))},
+		},
+	}, nil).Once()
+	s.On("ListMultipartUploads", mock.Anything, &s3.ListMultipartUploadsInput{
+		Bucket:         aws.String("b"),
+		Prefix:         aws.String("velero/"),
+		KeyMarker:      aws.String("velero/backups/b2/b2.tar.gz"),
+		UploadIdMarker: aws.String("upload-2"),
+	}).Return(&s3.ListMultipartUploadsOutput{
+		Uploads: []types.MultipartUpload{
+			{Key: aws.String("velero/backups/b3/b3.tar.gz"), UploadId: aws.String("upload-3"), Initiated: aws.Time(now.Add(-25 * time.Hour))},
+		},
+	}, nil).Once()
+
+	s.On("AbortMultipartUpload", mock.Anything, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String("b"),
+		Key:      aws.String("velero/backups/b1/b1.tar.gz"),
+		UploadId: aws.String("upload-1"),
+	}).Return(&s3.AbortMultipartUploadOutput{}, nil).Once()
+	// a failed abort does not stop the janitor
+	s.On("AbortMultipartUpload", mock.Anything, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String("b"),
+		Key:      aws.String("velero/backups/b3/b3.tar.gz"),
+		UploadId: aws.String("upload-3"),
+	}).Return(&s3.AbortMultipartUploadOutput{}, errors.New("bad")).Once()
+
+	o.abortOrphanedMultipartUploads(janitor, now)
+}
+
+func TestStartMultipartJanitorDisabled(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	o := &ObjectStore{
+		log: newLogger(),
+		s3:  s,
+	}
+
+	// no call is expected on the mock
+	o.startMultipartJanitor(multipartJanitor{bucket: "b"})
+}
+
+// sweepingS3 returns an S3 mock reporting the sweeps of the janitors on the
+// returned channel.
+func sweepingS3() (*mockS3, chan string) {
+	s := new(mockS3)
+	sweeps := make(chan string, 100)
+	s.On("ListMultipartUploads", mock.Anything, mock.Anything).Return(&s3.ListMultipartUploadsOutput{}, nil).Run(func(args mock.Arguments) {
+		sweeps <- aws.ToString(args.Get(1).(*s3.ListMultipartUploadsInput).Bucket)
+	})
+	return s, sweeps
+}
+
+func waitForSweep(t *testing.T, sweeps <-chan string) {
+	t.Helper()
+
+	select {
+	case <-sweeps:
+	case <-time.After(5 * time.Second):
+		t.Fatal("janitor did not sweep the location")
+	}
+}
+
+func TestStartMultipartJanitorOncePerLocation(t *testing.T) {
+	s, sweeps := sweepingS3()
+	defer s.AssertExpectations(t)
+
+	janitor := multipartJanitor{bucket: "swept", prefix: "velero/", maxAge: time.Hour, interval: 10 * time.Millisecond}
+	defer stopMultipartJanitor(janitor.key())
+
+	// every Init starts the janitor, which only runs once per location
+	for i := 0; i < 3; i++ {
+		o := &ObjectStore{
+			log: newLogger(),
+			s3:  s,
+		}
+		o.startMultipartJanitor(janitor)
+	}
+	multipartJanitors.Lock()
+	assert.Len(t, multipartJanitors.running, 1)
+	multipartJanitors.Unlock()
+
+	// the first sweep runs in the background, then on the interval
+	for i := 0; i < 2; i++ {
+		waitForSweep(t, sweeps)
+	}
+
+	stopMultipartJanitor(janitor.key())
+	multipartJanitors.Lock()
+	assert.Empty(t, multipartJanitors.running)
+	multipartJanitors.Unlock()
+}
+
+func TestStartMultipartJanitorFollowsSettings(t *testing.T) {
+	janitor := multipartJanitor{endpoint: "http://minio:9000", bucket: "resettled", prefix: "velero/", maxAge: time.Hour}
+	defer stopMultipartJanitor(janitor.key())
+
+	running := func() (multipartJanitor, bool) {
+		multipartJanitors.Lock()
+		defer multipartJanitors.Unlock()
+		r, ok := multipartJanitors.running[janitor.key()]
+		return r.janitor, ok
+	}
+
+	first, sweeps := sweepingS3()
+	(&ObjectStore{log: newLogger(), s3: first}).startMultipartJanitor(janitor)
+	waitForSweep(t, sweeps)
+
+	// a new maximum age restarts the janitor with the client of the new Init
+	changed := janitor
+	changed.maxAge = 2 * time.Hour
+	second, sweeps := sweepingS3()
+	(&ObjectStore{log: newLogger(), s3: second}).startMultipartJanitor(changed)
+	waitForSweep(t, sweeps)
+	current, ok := running()
+	require.True(t, ok)
+	assert.Equal(t, changed, current)
+
+	// turning the janitor off stops it
+	disabled := janitor
+	disabled.maxAge = 0
+	(&ObjectStore{log: newLogger(), s3: new(mockS3)}).startMultipartJanitor(disabled)
+	_, ok = running()
+	assert.False(t, ok)
+}
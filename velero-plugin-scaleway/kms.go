@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	key_manager "github.com/scaleway/scaleway-sdk-go/api/key_manager/v1alpha1"
+	"github.com/scaleway/scaleway-sdk-go/scw"
+)
+
+const (
+	kmsDataKeyCacheTTLKey = "kmsDataKeyCacheTTL"
+
+	defaultKMSDataKeyCacheTTL = 5 * time.Minute
+	// maxKMSDataKeyCacheSize bounds the number of data keys kept in memory.
+	maxKMSDataKeyCacheSize = 1024
+
+	kmsKeyProvider = "scw-key-manager"
+)
+
+// kmsKeyWrapper wraps data keys with a Scaleway Key Manager key. The data
+// keys it unwraps are cached for a bounded time, as Velero reads some objects
+// of a backup several times. The Velero CLI cannot unwrap them, so the objects
+// it encrypts are never served through signed URLs, see CreateSignedURL.
+type kmsKeyWrapper struct {
+	keyID   string
+	region  scw.Region
+	client  func(ctx context.Context) (*scw.Client, error)
+	retry   *retryPolicy
+	timeout time.Duration
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu           sync.Mutex
+	dataKeys     map[string]cachedDataKey
+	version      string
+	versionUntil time.Time
+}
+
+type cachedDataKey struct {
+	key     []byte
+	expires time.Time
+}
+
+func newKMSKeyWrapper(keyID string, region scw.Region, client func(ctx context.Context) (*scw.Client, error), retry *retryPolicy, timeout, ttl time.Duration) *kmsKeyWrapper {
+	return &kmsKeyWrapper{
+		keyID:    keyID,
+		region:   region,
+		client:   client,
+		retry:    retry,
+		timeout:  timeout,
+		ttl:      ttl,
+		now:      time.Now,
+		dataKeys: map[string]cachedDataKey{},
+	}
+}
+
+func (w *kmsKeyWrapper) provider() string {
+	return kmsKeyProvider
+}
+
+// call runs a Key Manager request with the retry policy, every attempt being
+// bounded by the timeout of the wrapper.
+func (w *kmsKeyWrapper) call(ctx context.Context, name string, fn func(api *key_manager.API, opt scw.RequestOption) error) error {
+	client, err := w.client(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	api := key_manager.NewAPI(client)
+	return w.retry.do(name, true, func(retryCtx context.Context) error {
+		// keep the caller deadline along with the Retry-After recorder of the attempt
+		attemptCtx := context.WithValue(ctx, retryAfterKey{}, retryCtx.Value(retryAfterKey{}))
+		op := newOperationContext(attemptCtx, name, w.timeout)
+		defer op.done()
+		return op.wrap(fn(api, scw.WithContext(op.ctx)))
+	})
+}
+
+// wrapKey encrypts dataKey with the key, and records the rotation of the key
+// used so older backups can be told apart.
+func (w *kmsKeyWrapper) wrapKey(ctx context.Context, dataKey []byte) (wrappedKey, error) {
+	version, err := w.keyVersion(ctx)
+	if err != nil {
+		return wrappedKey{}, err
+	}
+
+	var resp *key_manager.EncryptResponse
+	err = w.call(ctx, "KeyManagerEncrypt", func(api *key_manager.API, opt scw.RequestOption) (err error) {
+		resp, err = api.Encrypt(&key_manager.EncryptRequest{
+			Region:    w.region,
+			KeyID:     w.keyID,
+			Plaintext: dataKey,
+		}, opt)
+		return err
+	})
+	if err != nil {
+		return wrappedKey{}, errors.Wrapf(err, "error encrypting data key with key %s", w.keyID)
+	}
+	return wrappedKey{
+		data:    resp.Ciphertext,
+		keyID:   w.keyID,
+		version: version,
+	}, nil
+}
+
+// unwrapKey decrypts a data key with the key recorded in the object metadata.
+// Key Manager decrypts the data keys wrapped by any rotation of the key.
+func (w *kmsKeyWrapper) unwrapKey(ctx context.Context, wrapped wrappedKey) ([]byte, error) {
+	cacheKey := wrapped.keyID + "/" + string(wrapped.data)
+	if dataKey, ok := w.cachedDataKey(cacheKey); ok {
+		return dataKey, nil
+	}
+
+	var resp *key_manager.DecryptResponse
+	err := w.call(ctx, "KeyManagerDecrypt", func(api *key_manager.API, opt scw.RequestOption) (err error) {
+		resp, err = api.Decrypt(&key_manager.DecryptRequest{
+			Region:     w.region,
+			KeyID:      wrapped.keyID,
+			Ciphertext: wrapped.data,
+		}, opt)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decrypting data key with key %s (version %s)", wrapped.keyID, wrapped.version)
+	}
+
+	w.cacheDataKey(cacheKey, resp.Plaintext)
+	return resp.Plaintext, nil
+}
+
+// keyVersion returns the rotation count of the key, refreshed every ttl.
+func (w *kmsKeyWrapper) keyVersion(ctx context.Context) (string, error) {
+	w.mu.Lock()
+	if w.version != "" && w.now().Before(w.versionUntil) {
+		defer w.mu.Unlock()
+		return w.version, nil
+	}
+	w.mu.Unlock()
+
+	var key *key_manager.Key
+	err := w.call(ctx, "KeyManagerGetKey", func(api *key_manager.API, opt scw.RequestOption) (err error) {
+		key, err = api.GetKey(&key_manager.GetKeyRequest{
+			Region: w.region,
+			KeyID:  w.keyID,
+		}, opt)
+		return err
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "error getting key %s", w.keyID)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.version = strconv.FormatUint(uint64(key.RotationCount), 10)
+	w.versionUntil = w.now().Add(w.ttl)
+	return w.version, nil
+}
+
+func (w *kmsKeyWrapper) cachedDataKey(cacheKey string) ([]byte, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	cached, ok := w.dataKeys[cacheKey]
+	if !ok || !w.now().Before(cached.expires) {
+		delete(w.dataKeys, cacheKey)
+		return nil, false
+	}
+	return cached.key, true
+}
+
+func (w *kmsKeyWrapper) cacheDataKey(cacheKey string, dataKey []byte) {
+	if w.ttl == 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	if len(w.dataKeys) >= maxKMSDataKeyCacheSize {
+		for k, cached := range w.dataKeys {
+			if !now.Before(cached.expires) {
+				delete(w.dataKeys, k)
+			}
+		}
+	}
+	// still full of live keys, start over rather than growing
+	if len(w.dataKeys) >= maxKMSDataKeyCacheSize {
+		w.dataKeys = map[string]cachedDataKey{}
+	}
+	w.dataKeys[cacheKey] = cachedDataKey{key: dataKey, expires: now.Add(w.ttl)}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/scaleway/scaleway-sdk-go/scw"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keyManagerStandIn answers the Key Manager requests of kmsKeyWrapper. It
+// "encrypts" by prefixing the plaintext with the key ID and the rotation count.
+type keyManagerStandIn struct {
+	rotations atomic.Uint32
+	encrypts  atomic.Int32
+	decrypts  atomic.Int32
+}
+
+func (k *keyManagerStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/key-manager/v1alpha1/regions/fr-par/keys/")
+	keyID, action, _ := strings.Cut(path, "/")
+	var body struct {
+		Plaintext  []byte `json:"plaintext"`
+		Ciphertext []byte `json:"ciphertext"`
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	prefix := []byte(keyID + ":")
+	switch {
+	case r.Method == http.MethodGet && action == "":
+		json.NewEncoder(w).Encode(map[string]any{"id": keyID, "rotation_count": k.rotations.Load()})
+	case action == "encrypt":
+		k.encrypts.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{"key_id": keyID, "ciphertext": append(prefix, body.Plaintext...)})
+	case action == "decrypt" && bytes.HasPrefix(body.Ciphertext, prefix):
+		k.decrypts.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{"key_id": keyID, "plaintext": body.Ciphertext[len(prefix):]})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]any{"message": "not found"})
+	}
+}
+
+func newTestKMSKeyWrapper(t *testing.T, standIn *keyManagerStandIn) *kmsKeyWrapper {
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	client, err := scw.NewClient(
+		scw.WithAPIURL(server.URL),
+		scw.WithAuth("SCWXXXXXXXXXXXXXXXXX", "11111111-1111-1111-1111-111111111111"),
+		scw.WithDefaultRegion(scw.RegionFrPar),
+	)
+	require.NoError(t, err)
+
+	return newKMSKeyWrapper("key-1", scw.RegionFrPar, func(context.Context) (*scw.Client, error) {
+		return client, nil
+	}, newTestRetryPolicy(1, time.Minute), time.Minute, time.Minute)
+}
+
+func TestKMSEncryptionRoundTrip(t *testing.T) {
+	standIn := &keyManagerStandIn{}
+	w := newTestKMSKeyWrapper(t, standIn)
+
+	encrypted, metadata, err := encryptBody(context.Background(), w, strings.NewReader("backup"))
+	require.NoError(t, err)
+	ciphertext, err := io.ReadAll(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, kmsKeyProvider, metadata[encryptionProviderMetadataKey])
+	assert.Equal(t, "key-1", metadata[encryptionKeyIDMetadataKey])
+	assert.Equal(t, "0", metadata[encryptionKeyVerMetadataKey])
+
+	// the key is rotated, the version of the new objects follows
+	standIn.rotations.Store(1)
+	w.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	_, rotated, err := encryptBody(context.Background(), w, strings.NewReader("backup"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", rotated[encryptionKeyVerMetadataKey])
+	w.now = time.Now
+
+	// the data key is unwrapped once, then served by the cache
+	for i := 0; i < 2; i++ {
+		decrypted, err := decryptBody(context.Background(), w, io.NopCloser(bytes.NewReader(ciphertext)), metadata)
+		require.NoError(t, err)
+		data, err := io.ReadAll(decrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "backup", string(data))
+	}
+	assert.Equal(t, int32(2), standIn.encrypts.Load())
+	assert.Equal(t, int32(1), standIn.decrypts.Load())
+
+	// expired data keys are unwrapped again
+	w.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	_, err = decryptBody(context.Background(), w, io.NopCloser(bytes.NewReader(ciphertext)), metadata)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), standIn.decrypts.Load())
+}
+
+func TestKMSUnwrapUnknownKey(t *testing.T) {
+	w := newTestKMSKeyWrapper(t, &keyManagerStandIn{})
+
+	_, err := w.unwrapKey(context.Background(), wrappedKey{data: []byte("key-2:data"), keyID: "key-3", version: "4"})
+	assert.ErrorContains(t, err, "error decrypting data key with key key-3 (version 4)")
+}
+
+func TestInitWithKMSNeedsNoOrganizationNorZone(t *testing.T) {
+	// Key Manager only needs the credentials and the region
+	unsetSCWEnv(t)
+	t.Setenv(s3EndpointEnvVar, "")
+	require.NoError(t, os.Unsetenv(s3EndpointEnvVar))
+
+	o := newObjectStore(newLogger())
+	err := o.Init(map[string]string{
+		bucketKey:          "bucket",
+		regionKey:          "fr-par",
+		credentialsFileKey: writeTestFile(t, "credentials", testINICredentials),
+		configPathKey:      filepath.Join(t.TempDir(), "missing.yaml"),
+		credentialsDirKey:  t.TempDir(),
+		kmsKeyIDKey:        "key-1",
+	})
+	require.NoError(t, err)
+
+	kms, ok := o.keyWrapper.(*kmsKeyWrapper)
+	require.True(t, ok)
+	assert.Equal(t, "key-1", kms.keyID)
+	assert.Equal(t, scw.RegionFrPar, kms.region)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	objectLockModeKey          = "objectLockMode"
+	objectLockRetentionDaysKey = "objectLockRetentionDays"
+)
+
+// objectLockModes are the retention modes accepted by Scaleway Object Storage.
+var objectLockModes = []types.ObjectLockMode{
+	types.ObjectLockModeGovernance,
+	types.ObjectLockModeCompliance,
+}
+
+// objectLock is the retention applied to the uploaded objects.
+type objectLock struct {
+	mode      types.ObjectLockMode
+	retention time.Duration
+}
+
+// parseObjectLock reads the retention from the BSL config, both keys being
+// required together. A zero objectLock means the uploads are not locked.
+func parseObjectLock(config map[string]string) (objectLock, error) {
+	mode, days := config[objectLockModeKey], config[objectLockRetentionDaysKey]
+	if mode == "" && days == "" {
+		return objectLock{}, nil
+	}
+	if mode == "" || days == "" {
+		return objectLock{}, errors.Errorf("%s and %s must be set together", objectLockModeKey, objectLockRetentionDaysKey)
+	}
+
+	var lock objectLock
+	for _, m := range objectLockModes {
+		if string(m) == mode {
+			lock.mode = m
+		}
+	}
+	if lock.mode == "" {
+		return objectLock{}, errors.Errorf("invalid %s %q, valid modes are %v", objectLockModeKey, mode, objectLockModes)
+	}
+
+	parsed, err := strconv.Atoi(days)
+	if err != nil || parsed < 1 {
+		return objectLock{}, errors.Errorf("could not parse %s (expected a positive integer): %s", objectLockRetentionDaysKey, days)
+	}
+	lock.retention = time.Duration(parsed) * 24 * time.Hour
+	return lock, nil
+}
+
+// enabled tells whether uploads have to be locked.
+func (l objectLock) enabled() bool {
+	return l.mode != ""
+}
+
+// apply sets the retention of an object uploaded at now.
+func (l objectLock) apply(input *s3.PutObjectInput, now time.Time) {
+	if !l.enabled() {
+		return
+	}
+	input.ObjectLockMode = l.mode
+	input.ObjectLockRetainUntilDate = aws.Time(now.Add(l.retention).UTC())
+}
+
+// checkObjectLockEnabled fails when the bucket was not created with Object
+// Lock, as Scaleway would reject every locked upload.
+func (o *ObjectStore) checkObjectLockEnabled(bucket string) error {
+	config, err := o.objectLockConfiguration(bucket)
+	if err != nil {
+		return err
+	}
+	if config == nil || config.ObjectLockEnabled != types.ObjectLockEnabledEnabled {
+		return errors.Errorf("%s is set but Object Lock is not enabled on bucket %s", objectLockModeKey, bucket)
+	}
+	return nil
+}
+
+// objectLockConfiguration returns the Object Lock configuration of the
+// bucket, nil when the bucket has none.
+func (o *ObjectStore) objectLockConfiguration(bucket string) (*types.ObjectLockConfiguration, error) {
+	op := newOperation("GetObjectLockConfiguration", o.metadataTimeout)
+	defer op.done()
+
+	output, err := o.s3.GetObjectLockConfiguration(op.ctx, &s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "ObjectLockConfigurationNotFoundError" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(op.wrap(err), "error getting Object Lock configuration of bucket %s", bucket)
+	}
+	return output.ObjectLockConfiguration, nil
+}
+
+// bucketObjectLockEnabled tells whether Object Lock is enabled on the bucket.
+// It is known from Init when uploads are locked or the endpoint was probed,
+// and looked up at the first delete otherwise. A failed lookup is logged, the
+// deletes going on without the retention check.
+func (o *ObjectStore) bucketObjectLockEnabled(bucket string) bool {
+	o.objectLockLookup.Do(func() {
+		if o.capabilities.objectLock != capabilityUnknown {
+			return
+		}
+		config, err := o.objectLockConfiguration(bucket)
+		switch {
+		case err != nil:
+			o.log.WithError(err).WithField("bucket", bucket).Warn("Failed to get the Object Lock configuration of the bucket, locked objects will not be reported on delete")
+		case config != nil && config.ObjectLockEnabled == types.ObjectLockEnabledEnabled:
+			o.capabilities.objectLock = capabilitySupported
+		default:
+			o.capabilities.objectLock = capabilityUnsupported
+		}
+	})
+	return o.capabilities.objectLock == capabilitySupported
+}
+
+// checkRetention returns an ObjectLockedError when the current version of key
+// is under retention. A missing object has nothing to retain.
+func (o *ObjectStore) checkRetention(bucket, key string) error {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if o.sseCustomerKey != "" {
+		input.SSECustomerAlgorithm = aws.String("AES256")
+		input.SSECustomerKey = &o.sseCustomerKey
+	}
+
+	op := newOperation("HeadObject", o.metadataTimeout)
+	defer op.done()
+
+	output, err := o.s3.HeadObject(op.ctx, input)
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(op.wrap(err), "error checking the retention of object %s", key)
+	}
+	if output.ObjectLockRetainUntilDate == nil || !output.ObjectLockRetainUntilDate.After(time.Now()) {
+		return nil
+	}
+	return errors.WithStack(&ObjectLockedError{
+		Key:         key,
+		Mode:        string(output.ObjectLockMode),
+		RetainUntil: *output.ObjectLockRetainUntilDate,
+	})
+}
+
+// objectLockedError turns an AccessDenied returned when deleting a version of
+// key into an ObjectLockedError when the version is under retention. It
+// returns nil when the retention cannot be found.
+func (o *ObjectStore) objectLockedError(bucket, key, versionID string, err error) error {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "AccessDenied" {
+		return nil
+	}
+
+	op := newOperation("GetObjectRetention", o.metadataTimeout)
+	defer op.done()
+
+	input := &s3.GetObjectRetentionInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	output, retentionErr := o.s3.GetObjectRetention(op.ctx, input)
+	if retentionErr != nil || output.Retention == nil || output.Retention.RetainUntilDate == nil {
+		return nil
+	}
+	if !output.Retention.RetainUntilDate.After(time.Now()) {
+		return nil
+	}
+	return &ObjectLockedError{
+		Key:         key,
+		VersionID:   versionID,
+		Mode:        string(output.Retention.Mode),
+		RetainUntil: *output.Retention.RetainUntilDate,
+	}
+}
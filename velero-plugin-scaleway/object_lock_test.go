@@ -0,0 +1,248 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseObjectLock(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        map[string]string
+		expected      objectLock
+		expectedError string
+	}{
+		{
+			name:   "disabled",
+			config: map[string]string{},
+		},
+		{
+			name:     "compliance",
+			config:   map[string]string{objectLockModeKey: "COMPLIANCE", objectLockRetentionDaysKey: "30"},
+			expected: objectLock{mode: types.ObjectLockModeCompliance, retention: 30 * 24 * time.Hour},
+		},
+		{
+			name:          "missing days",
+			config:        map[string]string{objectLockModeKey: "GOVERNANCE"},
+			expectedError: "objectLockMode and objectLockRetentionDays must be set together",
+		},
+		{
+			name:          "invalid mode",
+			config:        map[string]string{objectLockModeKey: "governance", objectLockRetentionDaysKey: "30"},
+			expectedError: `invalid objectLockMode "governance", valid modes are [GOVERNANCE COMPLIANCE]`,
+		},
+		{
+			name:          "invalid days",
+			config:        map[string]string{objectLockModeKey: "GOVERNANCE", objectLockRetentionDaysKey: "0"},
+			expectedError: "could not parse objectLockRetentionDays (expected a positive integer): 0",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lock, err := parseObjectLock(tc.config)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, lock)
+		})
+	}
+}
+
+func TestObjectLockApply(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	input := &s3.PutObjectInput{}
+	objectLock{}.apply(input, now)
+	assert.Empty(t, input.ObjectLockMode)
+	assert.Nil(t, input.ObjectLockRetainUntilDate)
+
+	objectLock{mode: types.ObjectLockModeGovernance, retention: 7 * 24 * time.Hour}.apply(input, now)
+	assert.Equal(t, types.ObjectLockModeGovernance, input.ObjectLockMode)
+	assert.Equal(t, time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), *input.ObjectLockRetainUntilDate)
+}
+
+func TestCheckObjectLockEnabled(t *testing.T) {
+	tests := []struct {
+		name          string
+		output        *s3.GetObjectLockConfigurationOutput
+		errorResponse error
+		expectedError string
+	}{
+		{
+			name: "enabled",
+			output: &s3.GetObjectLockConfigurationOutput{
+				ObjectLockConfiguration: &types.ObjectLockConfiguration{ObjectLockEnabled: types.ObjectLockEnabledEnabled},
+			},
+		},
+		{
+			name:          "not configured",
+			output:        &s3.GetObjectLockConfigurationOutput{},
+			errorResponse: &smithy.GenericAPIError{Code: "ObjectLockConfigurationNotFoundError"},
+			expectedError: "objectLockMode is set but Object Lock is not enabled on bucket b",
+		},
+		{
+			name:          "error",
+			output:        &s3.GetObjectLockConfigurationOutput{},
+			errorResponse: errors.New("bad"),
+			expectedError: "error getting Object Lock configuration of bucket b: bad",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := new(mockS3)
+			defer s.AssertExpectations(t)
+
+			o := &ObjectStore{
+				log: newLogger(),
+				s3:  s,
+			}
+
+			s.On("GetObjectLockConfiguration", mock.Anything, &s3.GetObjectLockConfigurationInput{Bucket: aws.String("b")}).Return(tc.output, tc.errorResponse)
+
+			err := o.checkObjectLockEnabled("b")
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDeleteObjectUnderRetention(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	o := &ObjectStore{
+		log: newLogger(),
+		s3:  s,
+	}
+
+	retainUntil := time.Now().Add(24 * time.Hour)
+	// without access to the Object Lock configuration, the retention is found
+	// from the failed delete
+	s.On("GetObjectLockConfiguration", mock.Anything, mock.Anything).Return(&s3.GetObjectLockConfigurationOutput{}, &smithy.GenericAPIError{Code: "AccessDenied"}).Once()
+	s.On("DeleteObject", mock.Anything, &s3.DeleteObjectInput{
+		Bucket: aws.String("b"),
+		Key:    aws.String("k"),
+	}).Return(&s3.DeleteObjectOutput{}, &smithy.GenericAPIError{Code: "AccessDenied"})
+	s.On("GetObjectRetention", mock.Anything, &s3.GetObjectRetentionInput{
+		Bucket: aws.String("b"),
+		Key:    aws.String("k"),
+	}).Return(&s3.GetObjectRetentionOutput{
+		Retention: &types.ObjectLockRetention{Mode: types.ObjectLockRetentionModeCompliance, RetainUntilDate: aws.Time(retainUntil)},
+	}, nil)
+
+	err := o.DeleteObject("b", "k")
+	var lockedErr *ObjectLockedError
+	require.True(t, errors.As(err, &lockedErr))
+	assert.Equal(t, "k", lockedErr.Key)
+	assert.Equal(t, "COMPLIANCE", lockedErr.Mode)
+	assert.True(t, retainUntil.Equal(lockedErr.RetainUntil))
+	assert.Contains(t, err.Error(), "object k is retained until ")
+}
+
+func TestDeleteObjectChecksRetention(t *testing.T) {
+	retainUntil := time.Now().Add(24 * time.Hour)
+	deleteInput := &s3.DeleteObjectInput{Bucket: aws.String("b"), Key: aws.String("k")}
+	headInput := &s3.HeadObjectInput{Bucket: aws.String("b"), Key: aws.String("k")}
+	lockEnabled := &s3.GetObjectLockConfigurationOutput{
+		ObjectLockConfiguration: &types.ObjectLockConfiguration{ObjectLockEnabled: types.ObjectLockEnabledEnabled},
+	}
+
+	tests := []struct {
+		name          string
+		objectLock    capability
+		setup         func(s *mockS3)
+		expectedError string
+	}{
+		{
+			// the delete would only add a delete marker on top of the locked object
+			name:       "object under retention",
+			objectLock: capabilitySupported,
+			setup: func(s *mockS3) {
+				s.On("HeadObject", mock.Anything, headInput).Return(&s3.HeadObjectOutput{
+					ObjectLockMode:            types.ObjectLockModeGovernance,
+					ObjectLockRetainUntilDate: aws.Time(retainUntil),
+				}, nil).Twice()
+			},
+			expectedError: "object k is retained until " + retainUntil.UTC().Format(time.RFC3339) + " (GOVERNANCE mode)",
+		},
+		{
+			name:       "retention expired",
+			objectLock: capabilitySupported,
+			setup: func(s *mockS3) {
+				s.On("HeadObject", mock.Anything, headInput).Return(&s3.HeadObjectOutput{
+					ObjectLockMode:            types.ObjectLockModeGovernance,
+					ObjectLockRetainUntilDate: aws.Time(time.Now().Add(-time.Hour)),
+				}, nil).Twice()
+				s.On("DeleteObject", mock.Anything, deleteInput).Return(&s3.DeleteObjectOutput{}, nil).Twice()
+			},
+		},
+		{
+			name:       "object already deleted",
+			objectLock: capabilitySupported,
+			setup: func(s *mockS3) {
+				s.On("HeadObject", mock.Anything, headInput).Return(&s3.HeadObjectOutput{}, &types.NotFound{}).Twice()
+				s.On("DeleteObject", mock.Anything, deleteInput).Return(&s3.DeleteObjectOutput{}, nil).Twice()
+			},
+		},
+		{
+			name: "Object Lock looked up once",
+			setup: func(s *mockS3) {
+				s.On("GetObjectLockConfiguration", mock.Anything, &s3.GetObjectLockConfigurationInput{Bucket: aws.String("b")}).Return(lockEnabled, nil).Once()
+				s.On("HeadObject", mock.Anything, headInput).Return(&s3.HeadObjectOutput{
+					ObjectLockMode:            types.ObjectLockModeCompliance,
+					ObjectLockRetainUntilDate: aws.Time(retainUntil),
+				}, nil).Twice()
+			},
+			expectedError: "object k is retained until " + retainUntil.UTC().Format(time.RFC3339) + " (COMPLIANCE mode)",
+		},
+		{
+			name: "bucket without Object Lock",
+			setup: func(s *mockS3) {
+				s.On("GetObjectLockConfiguration", mock.Anything, mock.Anything).Return(&s3.GetObjectLockConfigurationOutput{}, &smithy.GenericAPIError{Code: "ObjectLockConfigurationNotFoundError"}).Once()
+				s.On("DeleteObject", mock.Anything, deleteInput).Return(&s3.DeleteObjectOutput{}, nil).Twice()
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := new(mockS3)
+			defer s.AssertExpectations(t)
+			tc.setup(s)
+
+			o := &ObjectStore{
+				log:          newLogger(),
+				s3:           s,
+				capabilities: endpointCapabilities{objectLock: tc.objectLock},
+			}
+
+			// the default mode deletes the current version only
+			for i := 0; i < 2; i++ {
+				err := o.DeleteObject("b", "k")
+				if tc.expectedError == "" {
+					require.NoError(t, err)
+					continue
+				}
+				var lockedErr *ObjectLockedError
+				require.True(t, errors.As(err, &lockedErr))
+				assert.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
@@ -18,12 +18,13 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"io"
+	"maps"
 	"os"
 	"slices"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	//scw "github.com/scaleway/scaleway-sdk-go/scw"
@@ -35,6 +36,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 
 	"github.com/pkg/errors"
+	"github.com/scaleway/scaleway-sdk-go/scw"
 	"github.com/sirupsen/logrus"
 
 	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/framework"
@@ -47,13 +49,21 @@ const (
 	customerKeyEncryptionFileKey = "customerKeyEncryptionFile"
 	s3ForcePathStyleKey          = "s3ForcePathStyle"
 	bucketKey                    = "bucket"
+	prefixKey                    = "prefix"
 	credentialProfileKey         = "profile"
 	configPathKey                = "configPath"
 	serverSideEncryptionKey      = "serverSideEncryption"
 	insecureSkipTLSVerifyKey     = "insecureSkipTLSVerify"
 	taggingKey                   = "tagging"
 	checksumAlgKey               = "checksumAlgorithm"
-	//caCertKey                    = "caCertKey"
+	caCertKey                    = "caCert"
+	storageClassKey              = "storageClass"
+	storageClassOverridesKey     = "storageClassOverrides"
+	restoreDaysKey               = "restoreDays"
+	restoreTimeoutKey            = "restoreTimeout"
+	credentialsFileKey           = "credentialsFile"
+	credentialsDirKey            = "credentialsDir"
+	deleteAllVersionsKey         = "deleteAllVersions"
 )
 
 type s3Interface interface {
@@ -61,6 +71,15 @@ type s3Interface interface {
 	GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
 	DeleteObject(ctx context.Context, input *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	DeleteObjects(ctx context.Context, input *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	RestoreObject(ctx context.Context, input *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error)
+	ListObjectVersions(ctx context.Context, input *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error)
+	ListMultipartUploads(ctx context.Context, input *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+	GetObjectLockConfiguration(ctx context.Context, input *s3.GetObjectLockConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetObjectLockConfigurationOutput, error)
+	GetObjectRetention(ctx context.Context, input *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error)
+	AbortMultipartUpload(ctx context.Context, input *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	HeadBucket(ctx context.Context, input *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	PutObject(ctx context.Context, input *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
 }
 
 type s3PresignInterface interface {
@@ -72,16 +91,37 @@ type ObjectStore struct {
 	s3                   s3Interface
 	preSignS3            s3PresignInterface
 	s3Uploader           *manager.Uploader
-	kmsKeyID             string
 	sseCustomerKey       string
+	keyWrapper           keyWrapper
+	compression          compression
 	signatureVersion     string
 	serverSideEncryption string
 	tagging              string
 	checksumAlg          string
+	checksumVerification string
+	capabilities         endpointCapabilities
+
+	storageClass          types.StorageClass
+	storageClassOverrides []storageClassOverride
+	restoreDays           int32
+	restoreTimeout        time.Duration
+	restorePollInterval   time.Duration
+	objectLock            objectLock
+	objectLockLookup      sync.Once
+	deleteAllVersions     bool
+
+	metadataTimeout   time.Duration
+	listTimeout       time.Duration
+	uploadTimeout     time.Duration
+	downloadTimeout   time.Duration
+	streamIdleTimeout time.Duration
 }
 
 func newObjectStore(logger logrus.FieldLogger) *ObjectStore {
-	return &ObjectStore{log: logger}
+	return &ObjectStore{
+		log:                 logger,
+		restorePollInterval: defaultRestorePollInterval,
+	}
 }
 
 func (o *ObjectStore) Init(config map[string]string) error {
@@ -97,6 +137,36 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		insecureSkipTLSVerifyKey,
 		taggingKey,
 		checksumAlgKey,
+		caCertKey,
+		storageClassKey,
+		storageClassOverridesKey,
+		restoreDaysKey,
+		restoreTimeoutKey,
+		credentialsFileKey,
+		configPathKey,
+		credentialsDirKey,
+		metadataTimeoutKey,
+		listTimeoutKey,
+		uploadTimeoutKey,
+		downloadTimeoutKey,
+		streamIdleTimeoutKey,
+		maxRetryAttemptsKey,
+		maxRetryElapsedKey,
+		uploadPartSizeKey,
+		uploadConcurrencyKey,
+		maxUploadPartsKey,
+		multipartUploadMaxAgeKey,
+		multipartJanitorIntervalKey,
+		objectLockModeKey,
+		objectLockRetentionDaysKey,
+		deleteAllVersionsKey,
+		encryptionKeyFileKey,
+		kmsDataKeyCacheTTLKey,
+		compressionKey,
+		compressionLevelKey,
+		compressionMinSizeKey,
+		checksumVerificationKey,
+		capabilityProbeKey,
 	); err != nil {
 		return err
 	}
@@ -107,46 +177,146 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		publicURL                 = config[publicURLKey]
 		kmsKeyID                  = config[kmsKeyIDKey]
 		customerKeyEncryptionFile = config[customerKeyEncryptionFileKey]
+		encryptionKeyFile         = config[encryptionKeyFileKey]
 		s3ForcePathStyleVal       = config[s3ForcePathStyleKey]
+		insecureSkipTLSVerifyVal  = config[insecureSkipTLSVerifyKey]
+		deleteAllVersionsVal      = config[deleteAllVersionsKey]
+		caCert                    = config[caCertKey]
+		credentialsFile           = config[credentialsFileKey]
+		configPath                = config[configPathKey]
+		profileName               = config[credentialProfileKey]
+		credentialsDir            = config[credentialsDirKey]
 		serverSideEncryption      = config[serverSideEncryptionKey]
 		tagging                   = config[taggingKey]
 		// note that bucket is automatically added to the config map
 		// by the server from the ObjectStorageProviderConfig so
 		// doesn't need to be explicitly set by the user within
 		// config.
-		bucket = config[bucketKey]
-		//configPath       = config[configPathKey]
-		//profileName      = config[credentialProfileKey]
-		s3ForcePathStyle bool
-		err              error
+		bucket                = config[bucketKey]
+		s3ForcePathStyle      bool
+		insecureSkipTLSVerify bool
+		err                   error
 	)
 
+	if s3URL == "" {
+		s3URL = os.Getenv(s3EndpointEnvVar)
+	}
+
+	if o.metadataTimeout, err = parseTimeout(config, metadataTimeoutKey, defaultMetadataTimeout); err != nil {
+		return err
+	}
+	if o.listTimeout, err = parseTimeout(config, listTimeoutKey, defaultListTimeout); err != nil {
+		return err
+	}
+	if o.uploadTimeout, err = parseTimeout(config, uploadTimeoutKey, defaultUploadTimeout); err != nil {
+		return err
+	}
+	if o.downloadTimeout, err = parseTimeout(config, downloadTimeoutKey, defaultDownloadTimeout); err != nil {
+		return err
+	}
+	if o.streamIdleTimeout, err = parseTimeout(config, streamIdleTimeoutKey, defaultStreamIdleTimeout); err != nil {
+		return err
+	}
+
+	retries, err := parseRetryPolicy(o.log, config)
+	if err != nil {
+		return err
+	}
+
+	uploadOpts, err := parseUploadOptions(config)
+	if err != nil {
+		return err
+	}
+
+	janitor, err := parseMultipartJanitor(config, o.uploadTimeout)
+	if err != nil {
+		return err
+	}
+
+	if o.objectLock, err = parseObjectLock(config); err != nil {
+		return err
+	}
+
+	if o.compression, err = parseCompression(config); err != nil {
+		return err
+	}
+
+	if o.checksumVerification, err = parseChecksumVerification(config); err != nil {
+		return err
+	}
+
+	probe, err := parseCapabilityProbe(config)
+	if err != nil {
+		return err
+	}
+
 	if s3ForcePathStyleVal != "" {
 		if s3ForcePathStyle, err = strconv.ParseBool(s3ForcePathStyleVal); err != nil {
 			return errors.Wrapf(err, "could not parse %s (expected bool)", s3ForcePathStyleKey)
 		}
 	}
 
-	cfg, err := newConfigBuilder(o.log).WithRegion(region).WithSCWCredentials().WithSCWURL().WithSCWCredentials().Build()
+	if insecureSkipTLSVerifyVal != "" {
+		if insecureSkipTLSVerify, err = strconv.ParseBool(insecureSkipTLSVerifyVal); err != nil {
+			return errors.Wrapf(err, "could not parse %s (expected bool)", insecureSkipTLSVerifyKey)
+		}
+	}
+
+	if deleteAllVersionsVal != "" {
+		if o.deleteAllVersions, err = strconv.ParseBool(deleteAllVersionsVal); err != nil {
+			return errors.Wrapf(err, "could not parse %s (expected bool)", deleteAllVersionsKey)
+		}
+	}
+
+	// the TLS settings are carried by the shared config, so the main client, the
+	// region discovery client and the publicUrl presign client all use them.
+	tlsConfig, err := newTLSConfig(insecureSkipTLSVerify, caCert)
+	if err != nil {
+		return err
+	}
+
+	// the region is resolved in the following order, the first one set wins:
+	// the BSL region, SCW_DEFAULT_REGION, the default region of the config file profile.
+	// Credentials follow the order of ScalewayCredentialsChain.
+	profile, err := loadSCWProfile(configPath, profileName)
+	if err != nil {
+		return errors.Wrapf(err, "could not load scw profile")
+	}
+	if region == "" && profile.DefaultRegion != nil {
+		region = *profile.DefaultRegion
+	}
+
+	chain, err := NewScalewayCredentialsChain(o.log, credentialsFile, configPath, profileName, credentialsDir)
+	if err != nil {
+		return errors.Wrapf(err, "could not load scw credentials")
+	}
+
+	if region != "" || s3URL != "" {
+		// report unsupported or mismatched regions at Init rather than on the first request
+		if _, err := endpointRegion(region, s3URL); err != nil {
+			return err
+		}
+	}
+
+	cfg, err := newConfigBuilder(o.log).WithRegion(region).WithCredentialsChain(chain).WithTLSConfig(tlsConfig).WithResponseTimeout(o.streamIdleTimeout).WithRetryPolicy(retries).Build()
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	// GetBucketRegion will attempt to get the region for a bucket using the
-	// client's configured region to determine which AWS partition to perform the query on.
+	// without an endpoint nor a region, look for the Scaleway region owning the bucket
 	if s3URL == "" && region == "" {
 		regionClient, err := newS3Client(cfg, s3URL, s3ForcePathStyle)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		region, err = manager.GetBucketRegion(context.Background(), regionClient, bucket, func(o *s3.Options) { o.Region = "us-east-1" })
+		op := newOperation("HeadBucket", o.metadataTimeout*time.Duration(len(scw.AllRegions)))
+		region, err = discoverBucketRegion(op.ctx, regionClient, bucket)
+		err = op.wrap(err)
+		op.done()
 		if err != nil {
 			o.log.Errorf("Failed to determine bucket's region bucket: %s, error: %v", bucket, err)
 			return err
 		}
-		if region == "" {
-			return fmt.Errorf("unable to determine bucket's region, bucket: %s", bucket)
-		}
 		cfg.Region = region
 	}
 
@@ -155,13 +325,12 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		return errors.WithStack(err)
 	}
 	o.s3 = client
-	o.s3Uploader = manager.NewUploader(client)
-	o.kmsKeyID = kmsKeyID
+	o.s3Uploader = newUploader(client, uploadOpts)
 	o.serverSideEncryption = serverSideEncryption
 	o.tagging = tagging
 
 	if customerKeyEncryptionFile != "" && kmsKeyID != "" {
-		return errors.Wrapf(err, "you cannot use %s and %s at the same time", kmsKeyIDKey, customerKeyEncryptionFileKey)
+		return errors.Errorf("you cannot use %s and %s at the same time", kmsKeyIDKey, customerKeyEncryptionFileKey)
 	}
 
 	if customerKeyEncryptionFile != "" {
@@ -172,6 +341,33 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		o.sseCustomerKey = customerKey
 	}
 
+	if encryptionKeyFile != "" {
+		if customerKeyEncryptionFile != "" || kmsKeyID != "" {
+			return errors.Errorf("you cannot use %s with %s or %s", encryptionKeyFileKey, customerKeyEncryptionFileKey, kmsKeyIDKey)
+		}
+		if o.keyWrapper, err = newFileKeyWrapper(encryptionKeyFile); err != nil {
+			return err
+		}
+	}
+
+	// Scaleway Object Storage rejects aws:kms, the key wraps the data keys of
+	// the client-side encryption instead.
+	if kmsKeyID != "" {
+		if cfg.Region == "" {
+			return errors.Errorf("%s requires a %s", kmsKeyIDKey, regionKey)
+		}
+		ttl, err := parseTimeout(config, kmsDataKeyCacheTTLKey, defaultKMSDataKeyCacheTTL)
+		if err != nil {
+			return err
+		}
+		// Key Manager is regional, it needs no organization nor default zone
+		kms, err := newClientBuilder(o.log).WithUserAgent(userAgentPrefix).WithEnvProfile().WithRegion(cfg.Region).WithRetryAfter().WithCredentialsChain(chain).BuildRegionalReloading(configPath, profileName)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		o.keyWrapper = newKMSKeyWrapper(kmsKeyID, scw.Region(cfg.Region), kms.Client, retries, o.metadataTimeout, ttl)
+	}
+
 	if publicURL != "" {
 		publicClient, err := newS3Client(cfg, publicURL, s3ForcePathStyle)
 		if err != nil {
@@ -196,6 +392,55 @@ func (o *ObjectStore) Init(config map[string]string) error {
 	} else {
 		o.checksumAlg = string(types.ChecksumAlgorithmCrc32)
 	}
+
+	if probe {
+		if err := o.probeCapabilitiesOnce(s3URL, cfg.Region, bucket, config[prefixKey]); err != nil {
+			return err
+		}
+	}
+
+	if o.objectLock.enabled() {
+		// locked uploads must carry an integrity check
+		if o.checksumAlgorithm() == "" {
+			return errors.Errorf("%s requires a %s supported by the endpoint", objectLockModeKey, checksumAlgKey)
+		}
+		switch o.capabilities.objectLock {
+		case capabilityUnsupported:
+			return errors.Errorf("%s is set but Object Lock is not enabled on bucket %s", objectLockModeKey, bucket)
+		case capabilityUnknown:
+			if err := o.checkObjectLockEnabled(bucket); err != nil {
+				return err
+			}
+			o.capabilities.objectLock = capabilitySupported
+		}
+	}
+
+	o.storageClass = types.StorageClassStandard
+	if class := config[storageClassKey]; class != "" {
+		if o.storageClass, err = parseStorageClass(class); err != nil {
+			return err
+		}
+	}
+	if o.storageClassOverrides, err = parseStorageClassOverrides(config[storageClassOverridesKey]); err != nil {
+		return err
+	}
+
+	o.restoreDays = defaultRestoreDays
+	if days := config[restoreDaysKey]; days != "" {
+		parsed, err := strconv.ParseInt(days, 10, 32)
+		if err != nil || parsed < 1 {
+			return errors.Errorf("could not parse %s (expected a positive integer): %s", restoreDaysKey, days)
+		}
+		o.restoreDays = int32(parsed)
+	}
+
+	if o.restoreTimeout, err = parseRestoreTimeout(config); err != nil {
+		return err
+	}
+
+	janitor.endpoint, janitor.region = s3URL, cfg.Region
+	janitor.credentials = credentialsSettings{file: credentialsFile, configPath: configPath, profile: profileName, dir: credentialsDir}
+	o.startMultipartJanitor(janitor)
 	return nil
 }
 
@@ -240,12 +485,11 @@ func (o *ObjectStore) PutObject(bucket, key string, body io.Reader) error {
 		Tagging: aws.String(o.tagging),
 	}
 
+	if storageClass := o.storageClassFor(key); storageClass != "" {
+		input.StorageClass = storageClass
+	}
+
 	switch {
-	// if kmsKeyID is not empty, assume a server-side encryption (SSE)
-	// algorithm of "aws:kms"
-	case o.kmsKeyID != "":
-		input.ServerSideEncryption = "aws:kms"
-		input.SSEKMSKeyId = &o.kmsKeyID
 	// if sseCustomerKey is not empty, assume SSE-C encryption with AES256 algorithm
 	case o.sseCustomerKey != "":
 		input.SSECustomerAlgorithm = aws.String("AES256")
@@ -255,13 +499,50 @@ func (o *ObjectStore) PutObject(bucket, key string, body io.Reader) error {
 		input.ServerSideEncryption = types.ServerSideEncryption(o.serverSideEncryption)
 	}
 
-	if o.checksumAlg != "" {
-		input.ChecksumAlgorithm = types.ChecksumAlgorithm(o.checksumAlg)
+	if !o.capabilities.tagging.usable() {
+		input.Tagging = nil
 	}
 
-	_, err := o.s3Uploader.Upload(context.Background(), input)
+	if alg := o.checksumAlgorithm(); alg != "" {
+		input.ChecksumAlgorithm = alg
+	}
+
+	o.objectLock.apply(input, time.Now())
+
+	// the idle timeout does not apply to the body, which Velero may produce
+	// slowly, the transport bounds the wait for the responses of S3 instead
+	op := newOperation("PutObject", o.uploadTimeout)
+	defer op.done()
+
+	// compress before encrypting, as encrypted data does not compress
+	compressed, metadata, err := o.compression.compressBody(key, input.Body)
+	if err != nil {
+		return errors.Wrapf(op.wrap(err), "error compressing object %s", key)
+	}
+	defer compressed.Close()
+	input.Body = compressed
+	input.Metadata = metadata
 
-	return errors.Wrapf(err, "error putting object %s", key)
+	if o.keyWrapper != nil {
+		body, metadata, err := encryptBody(op.ctx, o.keyWrapper, input.Body)
+		if err != nil {
+			return errors.Wrapf(op.wrap(err), "error encrypting object %s", key)
+		}
+		input.Body = body
+		if input.Metadata == nil {
+			input.Metadata = map[string]string{}
+		}
+		maps.Copy(input.Metadata, metadata)
+	}
+
+	_, err = o.s3Uploader.Upload(op.ctx, input)
+
+	var multipartErr manager.MultiUploadFailure
+	if errors.As(err, &multipartErr) && multipartErr.UploadID() != "" {
+		o.abortMultipartUpload(bucket, key, multipartErr.UploadID())
+	}
+
+	return errors.Wrapf(op.wrap(err), "error putting object %s", key)
 }
 
 // ObjectExists checks if there is an object with the given key in the object storage bucket.
@@ -283,8 +564,12 @@ func (o *ObjectStore) ObjectExists(bucket, key string) (bool, error) {
 		input.SSECustomerKey = &o.sseCustomerKey
 	}
 
+	op := newOperation("HeadObject", o.metadataTimeout)
+	defer op.done()
+
 	log.Debug("Checking if object exists")
-	if _, err := o.s3.HeadObject(context.Background(), input); err != nil {
+	if _, err := o.s3.HeadObject(op.ctx, input); err != nil {
+		err = op.wrap(err)
 		log.Debug("Checking for AWS specific error information")
 		var ne *types.NotFound
 		if errors.As(err, &ne) {
@@ -314,12 +599,48 @@ func (o *ObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
 		input.SSECustomerKey = &o.sseCustomerKey
 	}
 
-	output, err := o.s3.GetObject(context.Background(), input)
+	if o.verifyChecksums() {
+		input.ChecksumMode = types.ChecksumModeEnabled
+	}
+
+	op := newOperation("GetObject", o.downloadTimeout)
+	output, err := o.s3.GetObject(op.ctx, input, withoutSDKChecksumValidation)
+	// objects stored in GLACIER have to be restored before they can be read
+	var archived *types.InvalidObjectState
+	if errors.As(err, &archived) {
+		op.done()
+		if err := o.restoreArchivedObject(bucket, key); err != nil {
+			return nil, err
+		}
+		op = newOperation("GetObject", o.downloadTimeout)
+		output, err = o.s3.GetObject(op.ctx, input, withoutSDKChecksumValidation)
+	}
 	if err != nil {
+		err = op.wrap(err)
+		op.done()
 		return nil, errors.Wrapf(err, "error getting object %s", key)
 	}
 
-	return output.Body, nil
+	// the operation ends when Velero closes the body
+	body := newIdleReader(output.Body, op, o.streamIdleTimeout)
+
+	// objects uploaded without client-side encryption nor compression are returned as is
+	var content io.ReadCloser = body
+	if o.verifyChecksums() {
+		content = o.verifyBody(bucket, key, output, body)
+	}
+	if isEncrypted(output.Metadata) {
+		if content, err = decryptBody(op.ctx, o.keyWrapper, content, output.Metadata); err != nil {
+			body.Close()
+			return nil, errors.Wrapf(op.wrap(err), "error decrypting object %s", key)
+		}
+	}
+	decompressed, err := decompressBody(content, output.Metadata)
+	if err != nil {
+		content.Close()
+		return nil, errors.Wrapf(err, "error decompressing object %s", key)
+	}
+	return decompressed, nil
 }
 
 func (o *ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
@@ -328,12 +649,15 @@ func (o *ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]st
 		Prefix:    aws.String(prefix),
 		Delimiter: aws.String(delimiter),
 	}
+	op := newOperation("ListCommonPrefixes", o.listTimeout)
+	defer op.done()
+
 	var ret []string
 	p := s3.NewListObjectsV2Paginator(o.s3, input)
 	for p.HasMorePages() {
-		page, err := p.NextPage(context.Background())
+		page, err := p.NextPage(op.ctx)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, errors.WithStack(op.wrap(err))
 		}
 		for _, prefix := range page.CommonPrefixes {
 			ret = append(ret, *prefix.Prefix)
@@ -348,12 +672,15 @@ func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
 		Prefix: aws.String(prefix),
 	}
 
+	op := newOperation("ListObjects", o.listTimeout)
+	defer op.done()
+
 	var ret []string
 	p := s3.NewListObjectsV2Paginator(o.s3, input)
 	for p.HasMorePages() {
-		page, err := p.NextPage(context.Background())
+		page, err := p.NextPage(op.ctx)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, errors.WithStack(op.wrap(err))
 		}
 		for _, obj := range page.Contents {
 			ret = append(ret, *obj.Key)
@@ -368,18 +695,58 @@ func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
 }
 
 func (o *ObjectStore) DeleteObject(bucket, key string) error {
+	if o.deleteAllVersions {
+		return o.deleteAllObjectVersions(bucket, key)
+	}
+	// Velero waits for the outcome of every delete, so keys are deleted one by
+	// one: a DeleteObjects batch would remove keys Velero did not ask for yet.
+	// Only the versions of the key are batched, see deleteAllObjectVersions.
+	if o.bucketObjectLockEnabled(bucket) {
+		// buckets with Object Lock are versioned, deleting a locked object
+		// would only add a delete marker on top of it
+		if err := o.checkRetention(bucket, key); err != nil {
+			return err
+		}
+	}
+	return o.deleteObjectVersion(bucket, key, "")
+}
+
+// deleteObjectVersion deletes a version of key, an empty versionID deleting
+// the current version.
+func (o *ObjectStore) deleteObjectVersion(bucket, key, versionID string) error {
 	input := &s3.DeleteObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
 
-	_, err := o.s3.DeleteObject(context.Background(), input)
+	op := newOperation("DeleteObject", o.metadataTimeout)
+	defer op.done()
 
-	return errors.Wrapf(err, "error deleting object %s", key)
+	_, err := o.s3.DeleteObject(op.ctx, input)
+	if lockedErr := o.objectLockedError(bucket, key, versionID, err); lockedErr != nil {
+		return errors.WithStack(lockedErr)
+	}
+
+	return errors.Wrapf(op.wrap(err), "error deleting object %s", key)
 }
 
+// CreateSignedURL returns a URL downloading an object as stored. Objects
+// stored with client-side encryption or compression cannot be decoded by the
+// Velero CLI, so no URL is returned for them and the downloads of logs and
+// backups fail with an explicit error rather than serving ciphertext or zstd
+// frames.
 func (o *ObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (string, error) {
-	req, err := o.preSignS3.PresignGetObject(context.Background(), &s3.GetObjectInput{
+	if err := o.checkSignedDownload(bucket, key); err != nil {
+		return "", err
+	}
+
+	op := newOperation("PresignGetObject", o.metadataTimeout)
+	defer op.done()
+
+	req, err := o.preSignS3.PresignGetObject(op.ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	}, func(opts *s3.PresignOptions) {
@@ -387,7 +754,40 @@ func (o *ObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (st
 	})
 
 	if err != nil {
-		return "", errors.WithStack(err)
+		return "", errors.WithStack(op.wrap(err))
 	}
 	return req.URL, nil
 }
+
+// checkSignedDownload fails when an object would not be readable through a
+// signed URL. While client-side encryption or compression is configured, any
+// object may be encoded. Otherwise, the objects encoded before the settings
+// were turned off are told apart by their metadata.
+func (o *ObjectStore) checkSignedDownload(bucket, key string) error {
+	if o.keyWrapper != nil || o.compression.algorithm == compressionZstd {
+		return errors.Errorf("cannot create a signed URL for %s: signed downloads are not supported with client-side encryption or compression", key)
+	}
+
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if o.sseCustomerKey != "" {
+		input.SSECustomerAlgorithm = aws.String("AES256")
+		input.SSECustomerKey = &o.sseCustomerKey
+	}
+
+	op := newOperation("HeadObject", o.metadataTimeout)
+	defer op.done()
+
+	output, err := o.s3.HeadObject(op.ctx, input)
+	if err != nil {
+		// the download of a missing object fails on its own
+		o.log.WithError(op.wrap(err)).WithField("key", key).Debug("Failed to check the encoding of the object to sign")
+		return nil
+	}
+	if isEncrypted(output.Metadata) || output.Metadata[compressionMetadataKey] != "" {
+		return errors.Errorf("cannot create a signed URL for %s: the object is stored with client-side encryption or compression", key)
+	}
+	return nil
+}
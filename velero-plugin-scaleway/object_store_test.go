@@ -18,12 +18,18 @@ package main
 
 import (
 	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"testing"
-
+	"github.com/aws/smithy-go"
 	"github.com/pkg/errors"
+	"github.com/scaleway/scaleway-sdk-go/scw"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -53,6 +59,57 @@ func (m *mockS3) DeleteObject(ctx context.Context, input *s3.DeleteObjectInput,
 	return args.Get(0).(*s3.DeleteObjectOutput), args.Error(1)
 }
 
+func (m *mockS3) DeleteObjects(ctx context.Context, input *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.DeleteObjectsOutput), args.Error(1)
+}
+
+func (m *mockS3) RestoreObject(ctx context.Context, input *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.RestoreObjectOutput), args.Error(1)
+}
+
+func (m *mockS3) ListObjectVersions(ctx context.Context, input *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.ListObjectVersionsOutput), args.Error(1)
+}
+
+func (m *mockS3) ListMultipartUploads(ctx context.Context, input *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.ListMultipartUploadsOutput), args.Error(1)
+}
+
+func (m *mockS3) GetObjectLockConfiguration(ctx context.Context, input *s3.GetObjectLockConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetObjectLockConfigurationOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.GetObjectLockConfigurationOutput), args.Error(1)
+}
+
+func (m *mockS3) GetObjectRetention(ctx context.Context, input *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.GetObjectRetentionOutput), args.Error(1)
+}
+
+func (m *mockS3) AbortMultipartUpload(ctx context.Context, input *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.AbortMultipartUploadOutput), args.Error(1)
+}
+
+func (m *mockS3) PutObject(ctx context.Context, input *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.PutObjectOutput), args.Error(1)
+}
+
+// HeadBucket records the region set by the option functions, so tests can
+// check which regional endpoint is probed.
+func (m *mockS3) HeadBucket(ctx context.Context, input *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	var opts s3.Options
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	args := m.Called(ctx, input, opts.Region)
+	return args.Get(0).(*s3.HeadBucketOutput), args.Error(1)
+}
+
 func TestObjectExists(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -73,6 +130,12 @@ func TestObjectExists(t *testing.T) {
 			expectedExists: false,
 			expectedError:  "NoSuchKey: no such key",
 		},
+		{
+			// HeadObject answers 404 when the latest version is a delete marker
+			name:           "latest version is a delete marker",
+			errorResponse:  &types.NotFound{},
+			expectedExists: false,
+		},
 		{
 			name:           "error checking for existence",
 			errorResponse:  errors.Errorf("bad"),
@@ -98,7 +161,7 @@ func TestObjectExists(t *testing.T) {
 				Key:    aws.String(key),
 			}
 
-			s.On("HeadObject", context.Background(), req).Return(&s3.HeadObjectOutput{}, tc.errorResponse)
+			s.On("HeadObject", mock.Anything, req).Return(&s3.HeadObjectOutput{}, tc.errorResponse)
 
 			exists, err := o.ObjectExists(bucket, key)
 
@@ -152,3 +215,363 @@ func TestValidChecksumAlg(t *testing.T) {
 		})
 	}
 }
+
+func TestStorageClassFor(t *testing.T) {
+	overrides, err := parseStorageClassOverrides("*.tar.gz=GLACIER, *-logs.gz=ONEZONE_IA")
+	require.NoError(t, err)
+
+	o := &ObjectStore{
+		storageClass:          types.StorageClassStandard,
+		storageClassOverrides: overrides,
+	}
+
+	assert.Equal(t, types.StorageClassGlacier, o.storageClassFor("backups/b1/b1.tar.gz"))
+	assert.Equal(t, types.StorageClassOnezoneIa, o.storageClassFor("backups/b1/b1-logs.gz"))
+	assert.Equal(t, types.StorageClassStandard, o.storageClassFor("backups/b1/velero-backup.json"))
+}
+
+func TestParseStorageClassOverrides(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		expected      []storageClassOverride
+		expectedError string
+	}{
+		{
+			name:  "empty",
+			input: "",
+		},
+		{
+			name:     "single entry",
+			input:    "*.tar.gz=GLACIER",
+			expected: []storageClassOverride{{pattern: "*.tar.gz", storageClass: types.StorageClassGlacier}},
+		},
+		{
+			name:          "missing class",
+			input:         "*.tar.gz",
+			expectedError: `invalid storageClassOverrides entry "*.tar.gz", expected pattern=CLASS`,
+		},
+		{
+			name:          "unsupported class",
+			input:         "*.tar.gz=DEEP_ARCHIVE",
+			expectedError: `invalid storage class "DEEP_ARCHIVE", valid storage classes are [STANDARD ONEZONE_IA GLACIER]`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			overrides, err := parseStorageClassOverrides(tc.input)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, overrides)
+		})
+	}
+}
+
+func TestGetObjectRestoresArchivedObject(t *testing.T) {
+	tests := []struct {
+		name           string
+		sseCustomerKey string
+	}{
+		{
+			name: "unencrypted object",
+		},
+		{
+			name:           "SSE-C object",
+			sseCustomerKey: "01234567890123456789012345678901",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := new(mockS3)
+			defer s.AssertExpectations(t)
+
+			o := &ObjectStore{
+				log:                 newLogger(),
+				s3:                  s,
+				sseCustomerKey:      tc.sseCustomerKey,
+				restoreDays:         1,
+				restoreTimeout:      time.Minute,
+				restorePollInterval: time.Millisecond,
+			}
+
+			bucket := "b"
+			key := "k"
+			getReq := &s3.GetObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			}
+			headReq := &s3.HeadObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			}
+			if tc.sseCustomerKey != "" {
+				getReq.SSECustomerAlgorithm = aws.String("AES256")
+				getReq.SSECustomerKey = aws.String(tc.sseCustomerKey)
+				// the status of an SSE-C object can only be read with its key
+				headReq.SSECustomerAlgorithm = aws.String("AES256")
+				headReq.SSECustomerKey = aws.String(tc.sseCustomerKey)
+			}
+
+			s.On("GetObject", mock.Anything, getReq).Return(&s3.GetObjectOutput{}, &types.InvalidObjectState{StorageClass: types.StorageClassGlacier}).Once()
+			s.On("RestoreObject", mock.Anything, &s3.RestoreObjectInput{
+				Bucket:         aws.String(bucket),
+				Key:            aws.String(key),
+				RestoreRequest: &types.RestoreRequest{Days: aws.Int32(1)},
+			}).Return(&s3.RestoreObjectOutput{}, nil)
+			s.On("HeadObject", mock.Anything, headReq).Return(&s3.HeadObjectOutput{Restore: aws.String(`ongoing-request="true"`)}, nil).Once()
+			s.On("HeadObject", mock.Anything, headReq).Return(&s3.HeadObjectOutput{Restore: aws.String(`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`)}, nil).Once()
+			s.On("GetObject", mock.Anything, getReq).Return(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("data"))}, nil).Once()
+
+			body, err := o.GetObject(bucket, key)
+			require.NoError(t, err)
+
+			data, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.Equal(t, "data", string(data))
+		})
+	}
+}
+
+func TestParseRestoreTimeout(t *testing.T) {
+	timeout, err := parseRestoreTimeout(map[string]string{})
+	require.NoError(t, err)
+	assert.Zero(t, timeout)
+
+	timeout, err = parseRestoreTimeout(map[string]string{restoreTimeoutKey: "5m"})
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, timeout)
+
+	_, err = parseRestoreTimeout(map[string]string{restoreTimeoutKey: "12h"})
+	assert.EqualError(t, err, "restoreTimeout must be at most 10m0s, got 12h0m0s")
+}
+
+func TestGetObjectArchivedObjectRestoreInProgress(t *testing.T) {
+	restoreReq := &s3.RestoreObjectInput{
+		Bucket:         aws.String("b"),
+		Key:            aws.String("k"),
+		RestoreRequest: &types.RestoreRequest{Days: aws.Int32(1)},
+	}
+
+	tests := []struct {
+		name           string
+		restoreTimeout time.Duration
+		restoreErr     error
+		polls          int
+		expectedError  string
+	}{
+		{
+			// Velero gets an answer right after the restore request
+			name:          "default restore timeout",
+			expectedError: "object k is archived, its restore was requested: retry once it is restored",
+		},
+		{
+			name:          "restore already requested",
+			restoreErr:    &smithy.GenericAPIError{Code: "RestoreAlreadyInProgress"},
+			expectedError: "object k is archived, its restore was requested: retry once it is restored",
+		},
+		{
+			name:           "restore not completed in time",
+			restoreTimeout: 20 * time.Millisecond,
+			polls:          1,
+			expectedError:  "object k is archived, its restore is still in progress after ",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := new(mockS3)
+			defer s.AssertExpectations(t)
+
+			o := &ObjectStore{
+				log:                 newLogger(),
+				s3:                  s,
+				restoreDays:         1,
+				restoreTimeout:      tc.restoreTimeout,
+				restorePollInterval: time.Minute,
+			}
+
+			s.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{}, &types.InvalidObjectState{StorageClass: types.StorageClassGlacier}).Once()
+			s.On("RestoreObject", mock.Anything, restoreReq).Return(&s3.RestoreObjectOutput{}, tc.restoreErr).Once()
+			if tc.polls > 0 {
+				s.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{Restore: aws.String(`ongoing-request="true"`)}, nil)
+			}
+
+			_, err := o.GetObject("b", "k")
+			var inProgress *ObjectRestoreInProgressError
+			require.True(t, errors.As(err, &inProgress))
+			assert.Equal(t, "k", inProgress.Key)
+			assert.ErrorContains(t, err, tc.expectedError)
+		})
+	}
+}
+
+func TestDiscoverBucketRegion(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	req := &s3.HeadBucketInput{Bucket: aws.String("discovered")}
+	s.On("HeadBucket", mock.Anything, req, "fr-par").Return(&s3.HeadBucketOutput{}, &types.NotFound{}).Once()
+	s.On("HeadBucket", mock.Anything, req, "nl-ams").Return(&s3.HeadBucketOutput{}, nil).Once()
+
+	region, err := discoverBucketRegion(context.Background(), s, "discovered")
+	require.NoError(t, err)
+	assert.Equal(t, "nl-ams", region)
+
+	// the second lookup is answered by the cache
+	region, err = discoverBucketRegion(context.Background(), s, "discovered")
+	require.NoError(t, err)
+	assert.Equal(t, "nl-ams", region)
+}
+
+func TestDiscoverBucketRegionNotFound(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	req := &s3.HeadBucketInput{Bucket: aws.String("missing")}
+	s.On("HeadBucket", mock.Anything, req, mock.Anything).Return(&s3.HeadBucketOutput{}, &types.NotFound{Message: aws.String("not found")})
+
+	_, err := discoverBucketRegion(context.Background(), s, "missing")
+	require.Error(t, err)
+	for _, region := range scw.AllRegions {
+		assert.Contains(t, err.Error(), string(region)+" (NotFound: not found)")
+	}
+}
+
+func TestDiscoverBucketRegionTransientError(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	req := &s3.HeadBucketInput{Bucket: aws.String("flaky")}
+	// the bucket could live in fr-par, so the lookup stops there
+	s.On("HeadBucket", mock.Anything, req, "fr-par").Return(&s3.HeadBucketOutput{}, errors.New("connection reset")).Once()
+
+	_, err := discoverBucketRegion(context.Background(), s, "flaky")
+	assert.EqualError(t, err, "error looking for bucket flaky in region fr-par: connection reset")
+
+	// the failure is not cached, the next lookup finds the bucket
+	s.On("HeadBucket", mock.Anything, req, "fr-par").Return(&s3.HeadBucketOutput{}, nil).Once()
+	region, err := discoverBucketRegion(context.Background(), s, "flaky")
+	require.NoError(t, err)
+	assert.Equal(t, "fr-par", region)
+}
+
+type mockPresign struct {
+	mock.Mock
+}
+
+func (m *mockPresign) PresignGetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*v4.PresignedHTTPRequest), args.Error(1)
+}
+
+func TestCreateSignedURL(t *testing.T) {
+	const url = "https://b.s3.fr-par.scw.cloud/k?X-Amz-Signature=s"
+
+	tests := []struct {
+		name          string
+		keyWrapper    keyWrapper
+		compression   string
+		metadata      map[string]string
+		headError     error
+		expectedError string
+	}{
+		{
+			name: "plain object",
+		},
+		{
+			name:          "client-side encryption configured",
+			keyWrapper:    &fileKeyWrapper{},
+			expectedError: "cannot create a signed URL for k: signed downloads are not supported with client-side encryption or compression",
+		},
+		{
+			name:          "Key Manager encryption configured",
+			keyWrapper:    &kmsKeyWrapper{},
+			expectedError: "cannot create a signed URL for k: signed downloads are not supported with client-side encryption or compression",
+		},
+		{
+			name: "object encrypted with Key Manager before kmsKeyId was removed",
+			metadata: map[string]string{
+				encryptionAlgMetadataKey:      encryptionAlgorithm,
+				encryptionProviderMetadataKey: kmsKeyProvider,
+			},
+			expectedError: "cannot create a signed URL for k: the object is stored with client-side encryption or compression",
+		},
+		{
+			name:          "compression configured",
+			compression:   compressionZstd,
+			expectedError: "cannot create a signed URL for k: signed downloads are not supported with client-side encryption or compression",
+		},
+		{
+			name:          "object encrypted before encryption was turned off",
+			metadata:      map[string]string{encryptionAlgMetadataKey: encryptionAlgorithm},
+			expectedError: "cannot create a signed URL for k: the object is stored with client-side encryption or compression",
+		},
+		{
+			name:          "object compressed before compression was turned off",
+			metadata:      map[string]string{compressionMetadataKey: compressionZstd},
+			expectedError: "cannot create a signed URL for k: the object is stored with client-side encryption or compression",
+		},
+		{
+			name:      "object not found",
+			headError: &types.NotFound{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := new(mockS3)
+			defer s.AssertExpectations(t)
+			p := new(mockPresign)
+			defer p.AssertExpectations(t)
+
+			o := &ObjectStore{
+				log:         newLogger(),
+				s3:          s,
+				preSignS3:   p,
+				keyWrapper:  tc.keyWrapper,
+				compression: compression{algorithm: tc.compression},
+			}
+
+			if tc.keyWrapper == nil && tc.compression == "" {
+				s.On("HeadObject", mock.Anything, &s3.HeadObjectInput{Bucket: aws.String("b"), Key: aws.String("k")}).Return(&s3.HeadObjectOutput{Metadata: tc.metadata}, tc.headError)
+			}
+			if tc.expectedError == "" {
+				p.On("PresignGetObject", mock.Anything, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("k")}).Return(&v4.PresignedHTTPRequest{URL: url}, nil)
+			}
+
+			signed, err := o.CreateSignedURL("b", "k", time.Minute)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, url, signed)
+		})
+	}
+}
+
+func TestDeleteObjectOnlyDeletesTheRequestedKey(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	o := &ObjectStore{
+		log:          newLogger(),
+		s3:           s,
+		capabilities: endpointCapabilities{objectLock: capabilityUnsupported},
+	}
+
+	s.On("ListObjectsV2", mock.Anything, mock.Anything).Return(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("backups/b1/a")}, {Key: aws.String("backups/b1/b")}, {Key: aws.String("backups/b1/c")}},
+	}, nil)
+	s.On("DeleteObject", mock.Anything, &s3.DeleteObjectInput{Bucket: aws.String("bucket"), Key: aws.String("backups/b1/c")}).Return(&s3.DeleteObjectOutput{}, nil).Once()
+
+	_, err := o.ListObjects("bucket", "backups/b1/")
+	require.NoError(t, err)
+	// the keys listed after the deleted one are left for Velero to delete
+	require.NoError(t, o.DeleteObject("bucket", "backups/b1/c"))
+}
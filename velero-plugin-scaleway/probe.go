@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	capabilityProbeKey = "capabilityProbe"
+
+	// probeObjectKey is the reserved key written by the probe, under the prefix of the BSL.
+	probeObjectKey = ".velero-plugin-scaleway/capability-probe"
+)
+
+var probeContent = []byte("velero-plugin-scaleway capability probe")
+
+// unsupportedFeatureCodes are the error codes of the endpoints rejecting a
+// feature they do not implement.
+var unsupportedFeatureCodes = []string{"NotImplemented", "InvalidArgument", "InvalidRequest"}
+
+// capability is the support of a feature by the endpoint. Features whose
+// support is unknown are used as configured.
+type capability int
+
+const (
+	capabilityUnknown capability = iota
+	capabilitySupported
+	capabilityUnsupported
+)
+
+func (c capability) String() string {
+	switch c {
+	case capabilitySupported:
+		return "supported"
+	case capabilityUnsupported:
+		return "unsupported"
+	default:
+		return "unknown"
+	}
+}
+
+// usable tells whether a configured feature can be sent to the endpoint.
+func (c capability) usable() bool {
+	return c != capabilityUnsupported
+}
+
+// endpointCapabilities are the features of the endpoint found by the probe
+// run at Init.
+type endpointCapabilities struct {
+	checksums      capability
+	tagging        capability
+	sseCustomerKey capability
+	objectLock     capability
+}
+
+// probeKey identifies a probe by the location and the features it checks.
+type probeKey struct {
+	endpoint       string
+	region         string
+	bucket         string
+	prefix         string
+	checksumAlg    string
+	tagging        string
+	sseCustomerKey bool
+}
+
+// locationProbe is the probe of a location. Its lock only serializes the Inits
+// on the location, the locations being probed in parallel.
+type locationProbe struct {
+	sync.Mutex
+	done         bool
+	capabilities endpointCapabilities
+}
+
+// probedCapabilities caches the capabilities found by the probes of the
+// process, as Velero calls Init on every new plugin instance.
+var probedCapabilities = struct {
+	sync.Mutex
+	probes map[probeKey]*locationProbe
+}{probes: map[probeKey]*locationProbe{}}
+
+// parseCapabilityProbe tells whether Init probes the endpoint. The probe
+// writes to the bucket, so it is only run when enabled.
+func parseCapabilityProbe(config map[string]string) (bool, error) {
+	value := config[capabilityProbeKey]
+	if value == "" {
+		return false, nil
+	}
+	probe, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.Wrapf(err, "could not parse %s (expected bool)", capabilityProbeKey)
+	}
+	return probe, nil
+}
+
+// checksumAlgorithm returns the checksum algorithm of the requests, empty when
+// the endpoint does not support flexible checksums.
+func (o *ObjectStore) checksumAlgorithm() types.ChecksumAlgorithm {
+	if !o.capabilities.checksums.usable() {
+		return ""
+	}
+	return types.ChecksumAlgorithm(o.checksumAlg)
+}
+
+// probeCapabilitiesOnce probes the endpoint at the first Init of the process
+// on a location, and reuses the capabilities found at the next ones.
+func (o *ObjectStore) probeCapabilitiesOnce(endpoint, region, bucket, prefix string) error {
+	key := probeKey{
+		endpoint:       endpoint,
+		region:         region,
+		bucket:         bucket,
+		prefix:         prefix,
+		checksumAlg:    o.checksumAlg,
+		tagging:        o.tagging,
+		sseCustomerKey: o.sseCustomerKey != "",
+	}
+
+	probedCapabilities.Lock()
+	probe, ok := probedCapabilities.probes[key]
+	if !ok {
+		probe = &locationProbe{}
+		probedCapabilities.probes[key] = probe
+	}
+	probedCapabilities.Unlock()
+
+	// the Inits on the location wait for the probe in progress, a failed probe
+	// being run again by the next Init
+	probe.Lock()
+	defer probe.Unlock()
+
+	if probe.done {
+		o.capabilities = probe.capabilities
+		return nil
+	}
+	if err := o.probeCapabilities(bucket, prefix); err != nil {
+		return err
+	}
+	probe.done, probe.capabilities = true, o.capabilities
+	return nil
+}
+
+// probeCapabilities finds which of the configured features the endpoint
+// supports by writing a small object under a reserved key, with each feature
+// on its own, then deleting it. Unsupported checksums and tagging are left out
+// of the uploads, whereas an unsupported SSE-C fails as the objects would
+// otherwise be stored unencrypted. The probe is skipped when the bucket cannot
+// be written, e.g. for read-only locations.
+func (o *ObjectStore) probeCapabilities(bucket, prefix string) error {
+	key := path.Join(prefix, probeObjectKey)
+	log := o.log.WithFields(
+		logrus.Fields{
+			"bucket": bucket,
+			"key":    key,
+		},
+	)
+
+	lockConfig, err := o.objectLockConfiguration(bucket)
+	switch {
+	case err != nil:
+		log.WithError(err).Warn("Failed to get the Object Lock configuration of the bucket")
+	case lockConfig != nil && lockConfig.ObjectLockEnabled == types.ObjectLockEnabledEnabled:
+		o.capabilities.objectLock = capabilitySupported
+		// a default retention would lock the probe objects for good
+		if lockConfig.Rule != nil && lockConfig.Rule.DefaultRetention != nil {
+			log.Info("Bucket has a default retention, skipping the capability probe")
+			return nil
+		}
+	default:
+		o.capabilities.objectLock = capabilityUnsupported
+	}
+
+	var versions []string
+	defer func() {
+		// unversioned buckets hold a single probe object
+		for _, versionID := range slices.Compact(versions) {
+			if err := o.deleteObjectVersion(bucket, key, versionID); err != nil {
+				log.WithError(err).Warn("Failed to delete the capability probe")
+			}
+		}
+	}()
+
+	// the plain upload tells whether the features can be probed at all
+	versionID, err := o.putProbe(bucket, key, func(*s3.PutObjectInput) {})
+	if err != nil {
+		log.WithError(err).Warn("Failed to write the capability probe, using the configured features as is")
+		return nil
+	}
+	versions = append(versions, versionID)
+	if err := o.headProbe(bucket, key, versionID, false); err != nil {
+		log.WithError(err).Warn("Failed to read the capability probe, using the configured features as is")
+		return nil
+	}
+
+	if o.checksumAlg != "" {
+		o.capabilities.checksums, versions = o.probeFeature(log, "checksums", bucket, key, versions, func(input *s3.PutObjectInput) {
+			input.ChecksumAlgorithm = types.ChecksumAlgorithm(o.checksumAlg)
+		})
+		if !o.capabilities.checksums.usable() {
+			log.Warnf("Endpoint does not support the %s checksums, uploading objects without checksum", o.checksumAlg)
+		}
+	}
+
+	if o.tagging != "" {
+		o.capabilities.tagging, versions = o.probeFeature(log, "tagging", bucket, key, versions, func(input *s3.PutObjectInput) {
+			input.Tagging = aws.String(o.tagging)
+		})
+		if !o.capabilities.tagging.usable() {
+			log.Warn("Endpoint does not support object tagging, uploading objects without tags")
+		}
+	}
+
+	if o.sseCustomerKey != "" {
+		o.capabilities.sseCustomerKey, versions = o.probeFeature(log, "SSE-C", bucket, key, versions, func(input *s3.PutObjectInput) {
+			input.SSECustomerAlgorithm = aws.String("AES256")
+			input.SSECustomerKey = &o.sseCustomerKey
+		})
+		if o.capabilities.sseCustomerKey == capabilitySupported {
+			if err := o.headProbe(bucket, key, versions[len(versions)-1], true); err != nil {
+				log.WithError(err).Debug("Failed to read the capability probe with the customer key")
+				if isUnsupportedFeature(err) {
+					o.capabilities.sseCustomerKey = capabilityUnsupported
+				} else {
+					o.capabilities.sseCustomerKey = capabilityUnknown
+				}
+			}
+		}
+		if !o.capabilities.sseCustomerKey.usable() {
+			return errors.Errorf("%s is set but the endpoint does not support SSE-C", customerKeyEncryptionFileKey)
+		}
+	}
+
+	log.WithFields(
+		logrus.Fields{
+			"checksums":  o.capabilities.checksums,
+			"tagging":    o.capabilities.tagging,
+			"sseC":       o.capabilities.sseCustomerKey,
+			"objectLock": o.capabilities.objectLock,
+		},
+	).Info("Probed endpoint capabilities")
+	return nil
+}
+
+// probeFeature uploads the probe with a feature. The feature is unsupported
+// when the endpoint rejects the upload as not implemented, and unknown when
+// the upload fails for any other reason, e.g. throttling or a missing
+// permission, so that the feature is used as configured.
+func (o *ObjectStore) probeFeature(log logrus.FieldLogger, feature, bucket, key string, versions []string, withFeature func(*s3.PutObjectInput)) (capability, []string) {
+	versionID, err := o.putProbe(bucket, key, withFeature)
+	switch {
+	case isUnsupportedFeature(err):
+		log.WithError(err).WithField("feature", feature).Debug("Endpoint rejected the capability probe")
+		return capabilityUnsupported, versions
+	case err != nil:
+		log.WithError(err).WithField("feature", feature).Warn("Failed to probe the endpoint, using the feature as configured")
+		return capabilityUnknown, versions
+	}
+	return capabilitySupported, append(versions, versionID)
+}
+
+// isUnsupportedFeature tells whether a request failed as the endpoint does not
+// implement a feature it carries.
+func isUnsupportedFeature(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && slices.Contains(unsupportedFeatureCodes, apiErr.ErrorCode())
+}
+
+// putProbe writes the probe object and returns its version, empty when the
+// bucket is not versioned.
+func (o *ObjectStore) putProbe(bucket, key string, withFeature func(*s3.PutObjectInput)) (string, error) {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(probeContent),
+	}
+	withFeature(input)
+
+	op := newOperation("PutObject", o.metadataTimeout)
+	defer op.done()
+
+	output, err := o.s3.PutObject(op.ctx, input)
+	if err != nil {
+		return "", errors.WithStack(op.wrap(err))
+	}
+	return aws.ToString(output.VersionId), nil
+}
+
+func (o *ObjectStore) headProbe(bucket, key, versionID string, withCustomerKey bool) error {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	if withCustomerKey {
+		input.SSECustomerAlgorithm = aws.String("AES256")
+		input.SSECustomerKey = &o.sseCustomerKey
+	}
+
+	op := newOperation("HeadObject", o.metadataTimeout)
+	defer op.done()
+
+	_, err := o.s3.HeadObject(op.ctx, input)
+	return errors.WithStack(op.wrap(err))
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const testProbeKey = "velero/.velero-plugin-scaleway/capability-probe"
+
+// probeInput matches the probe uploads sending the given feature.
+func probeInput(feature string) interface{} {
+	return mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+		if aws.ToString(input.Key) != testProbeKey {
+			return false
+		}
+		switch feature {
+		case "checksums":
+			return input.ChecksumAlgorithm != ""
+		case "tagging":
+			return input.Tagging != nil
+		case "SSE-C":
+			return input.SSECustomerKey != nil
+		default:
+			return input.ChecksumAlgorithm == "" && input.Tagging == nil && input.SSECustomerKey == nil
+		}
+	})
+}
+
+func TestParseCapabilityProbe(t *testing.T) {
+	probe, err := parseCapabilityProbe(map[string]string{})
+	require.NoError(t, err)
+	assert.False(t, probe)
+
+	probe, err = parseCapabilityProbe(map[string]string{capabilityProbeKey: "true"})
+	require.NoError(t, err)
+	assert.True(t, probe)
+
+	_, err = parseCapabilityProbe(map[string]string{capabilityProbeKey: "maybe"})
+	assert.Error(t, err)
+}
+
+func TestProbeCapabilities(t *testing.T) {
+	rejected := &smithy.GenericAPIError{Code: "NotImplemented"}
+	noLock := &smithy.GenericAPIError{Code: "ObjectLockConfigurationNotFoundError"}
+
+	tests := []struct {
+		name          string
+		sseCustomer   bool
+		lockConfig    *types.ObjectLockConfiguration
+		putErrors     map[string]error
+		versioned     bool
+		expected      endpointCapabilities
+		expectedError string
+	}{
+		{
+			name: "everything supported",
+			expected: endpointCapabilities{
+				checksums:  capabilitySupported,
+				tagging:    capabilitySupported,
+				objectLock: capabilityUnsupported,
+			},
+		},
+		{
+			name:      "checksums and tagging rejected",
+			putErrors: map[string]error{"checksums": rejected, "tagging": rejected},
+			expected: endpointCapabilities{
+				checksums:  capabilityUnsupported,
+				tagging:    capabilityUnsupported,
+				objectLock: capabilityUnsupported,
+			},
+		},
+		{
+			name:      "checksums probe interrupted",
+			putErrors: map[string]error{"checksums": errors.New("connection reset")},
+			expected: endpointCapabilities{
+				checksums:  capabilityUnknown,
+				tagging:    capabilitySupported,
+				objectLock: capabilityUnsupported,
+			},
+		},
+		{
+			name: "checksums throttled and tagging denied",
+			putErrors: map[string]error{
+				"checksums": &smithy.GenericAPIError{Code: "SlowDown"},
+				"tagging":   &smithy.GenericAPIError{Code: "AccessDenied"},
+			},
+			expected: endpointCapabilities{
+				checksums:  capabilityUnknown,
+				tagging:    capabilityUnknown,
+				objectLock: capabilityUnsupported,
+			},
+		},
+		{
+			name:        "SSE-C probe failing on a server error",
+			sseCustomer: true,
+			putErrors:   map[string]error{"SSE-C": &smithy.GenericAPIError{Code: "InternalError"}},
+			expected: endpointCapabilities{
+				checksums:      capabilitySupported,
+				tagging:        capabilitySupported,
+				sseCustomerKey: capabilityUnknown,
+				objectLock:     capabilityUnsupported,
+			},
+		},
+		{
+			name:      "read-only bucket",
+			putErrors: map[string]error{"": &smithy.GenericAPIError{Code: "AccessDenied"}},
+			expected:  endpointCapabilities{objectLock: capabilityUnsupported},
+		},
+		{
+			name:          "SSE-C rejected",
+			sseCustomer:   true,
+			putErrors:     map[string]error{"SSE-C": rejected},
+			expectedError: "customerKeyEncryptionFile is set but the endpoint does not support SSE-C",
+		},
+		{
+			name:       "versioned bucket with Object Lock",
+			versioned:  true,
+			lockConfig: &types.ObjectLockConfiguration{ObjectLockEnabled: types.ObjectLockEnabledEnabled},
+			expected: endpointCapabilities{
+				checksums:  capabilitySupported,
+				tagging:    capabilitySupported,
+				objectLock: capabilitySupported,
+			},
+		},
+		{
+			name: "default retention",
+			lockConfig: &types.ObjectLockConfiguration{
+				ObjectLockEnabled: types.ObjectLockEnabledEnabled,
+				Rule: &types.ObjectLockRule{
+					DefaultRetention: &types.DefaultRetention{Mode: types.ObjectLockRetentionModeGovernance, Days: aws.Int32(1)},
+				},
+			},
+			expected: endpointCapabilities{objectLock: capabilitySupported},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := new(mockS3)
+			defer s.AssertExpectations(t)
+
+			o := &ObjectStore{
+				log:         newLogger(),
+				s3:          s,
+				checksumAlg: string(types.ChecksumAlgorithmCrc32),
+				tagging:     "velero=true",
+			}
+			if tc.sseCustomer {
+				o.sseCustomerKey = "01234567890123456789012345678901"
+			}
+
+			if tc.lockConfig != nil {
+				s.On("GetObjectLockConfiguration", mock.Anything, mock.Anything).Return(&s3.GetObjectLockConfigurationOutput{ObjectLockConfiguration: tc.lockConfig}, nil)
+			} else {
+				s.On("GetObjectLockConfiguration", mock.Anything, mock.Anything).Return((*s3.GetObjectLockConfigurationOutput)(nil), noLock)
+			}
+
+			uploads := 0
+			if tc.lockConfig == nil || tc.lockConfig.Rule == nil {
+				for _, feature := range []string{"", "checksums", "tagging", "SSE-C"} {
+					if feature == "SSE-C" && !tc.sseCustomer {
+						continue
+					}
+					if err := tc.putErrors[feature]; err != nil {
+						s.On("PutObject", mock.Anything, probeInput(feature)).Return((*s3.PutObjectOutput)(nil), err).Once()
+						if feature == "" {
+							break
+						}
+						continue
+					}
+					uploads++
+					output := &s3.PutObjectOutput{}
+					if tc.versioned {
+						output.VersionId = aws.String(strconv.Itoa(uploads))
+					}
+					s.On("PutObject", mock.Anything, probeInput(feature)).Return(output, nil).Once()
+				}
+			}
+
+			if uploads > 0 {
+				s.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, nil)
+				deletes := 1
+				if tc.versioned {
+					deletes = uploads
+				}
+				s.On("DeleteObject", mock.Anything, mock.MatchedBy(func(input *s3.DeleteObjectInput) bool {
+					return aws.ToString(input.Key) == testProbeKey && (input.VersionId != nil) == tc.versioned
+				})).Return(&s3.DeleteObjectOutput{}, nil).Times(deletes)
+			}
+
+			err := o.probeCapabilities("b", "velero")
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, o.capabilities)
+		})
+	}
+}
+
+func TestProbeCapabilitiesOnce(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	s.On("GetObjectLockConfiguration", mock.Anything, mock.Anything).Return((*s3.GetObjectLockConfigurationOutput)(nil), &smithy.GenericAPIError{Code: "ObjectLockConfigurationNotFoundError"}).Once()
+	s.On("PutObject", mock.Anything, probeInput("")).Return(&s3.PutObjectOutput{}, nil).Once()
+	s.On("PutObject", mock.Anything, probeInput("checksums")).Return(&s3.PutObjectOutput{}, nil).Once()
+	s.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, nil).Once()
+	s.On("DeleteObject", mock.Anything, mock.Anything).Return(&s3.DeleteObjectOutput{}, nil).Once()
+
+	expected := endpointCapabilities{
+		checksums:  capabilitySupported,
+		objectLock: capabilityUnsupported,
+	}
+	// the second Init of the process on the location reuses the first probe
+	for i := 0; i < 2; i++ {
+		o := &ObjectStore{
+			log:         newLogger(),
+			s3:          s,
+			checksumAlg: string(types.ChecksumAlgorithmCrc32),
+		}
+		require.NoError(t, o.probeCapabilitiesOnce("https://s3.fr-par.scw.cloud", "fr-par", "probed-once", "velero"))
+		assert.Equal(t, expected, o.capabilities)
+	}
+}
+
+func TestProbeCapabilitiesInParallel(t *testing.T) {
+	// a bucket with a default retention ends the probe after the Object Lock lookup
+	retained := &s3.GetObjectLockConfigurationOutput{
+		ObjectLockConfiguration: &types.ObjectLockConfiguration{
+			ObjectLockEnabled: types.ObjectLockEnabledEnabled,
+			Rule:              &types.ObjectLockRule{DefaultRetention: &types.DefaultRetention{Days: aws.Int32(1)}},
+		},
+	}
+
+	probing, release := make(chan struct{}), make(chan struct{})
+	slow := new(mockS3)
+	slow.On("GetObjectLockConfiguration", mock.Anything, mock.Anything).Run(func(mock.Arguments) {
+		close(probing)
+		<-release
+	}).Return(retained, nil).Once()
+	fast := new(mockS3)
+	fast.On("GetObjectLockConfiguration", mock.Anything, mock.Anything).Return(retained, nil).Once()
+
+	slowDone := make(chan error)
+	go func() {
+		o := &ObjectStore{log: newLogger(), s3: slow}
+		slowDone <- o.probeCapabilitiesOnce("http://slow:9000", "", "stalled", "velero")
+	}()
+	<-probing
+
+	// the stalled endpoint does not hold the Init of another location
+	fastDone := make(chan error)
+	go func() {
+		o := &ObjectStore{log: newLogger(), s3: fast}
+		fastDone <- o.probeCapabilitiesOnce("https://s3.fr-par.scw.cloud", "fr-par", "unrelated", "velero")
+	}()
+	select {
+	case err := <-fastDone:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("probe of an unrelated location waited for the stalled one")
+	}
+
+	close(release)
+	require.NoError(t, <-slowDone)
+	slow.AssertExpectations(t)
+	fast.AssertExpectations(t)
+}
+
+func TestChecksumAlgorithm(t *testing.T) {
+	o := &ObjectStore{
+		checksumAlg: string(types.ChecksumAlgorithmCrc32),
+		capabilities: endpointCapabilities{
+			checksums: capabilityUnsupported,
+		},
+	}
+	assert.Empty(t, o.checksumAlgorithm())
+
+	o.capabilities.checksums = capabilityUnknown
+	assert.Equal(t, types.ChecksumAlgorithmCrc32, o.checksumAlgorithm())
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/pkg/errors"
+	"github.com/scaleway/scaleway-sdk-go/scw"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxRetryAttemptsKey = "maxRetryAttempts"
+	maxRetryElapsedKey  = "maxRetryElapsed"
+
+	defaultMaxRetryAttempts = 5
+	defaultMaxRetryElapsed  = 2 * time.Minute
+	defaultRetryBaseDelay   = 500 * time.Millisecond
+	defaultRetryMaxDelay    = 30 * time.Second
+)
+
+// retryPolicy is the retry policy shared by the S3 and the Block API clients:
+// exponential backoff with full jitter, bounded by a number of attempts and by
+// the time spent retrying. A Retry-After sent by Scaleway takes precedence over
+// a shorter backoff. Each request has a single retry layer: the S3 requests
+// are retried by the AWS SDK with s3Retryer, the Scaleway SDK requests by do.
+type retryPolicy struct {
+	log         logrus.FieldLogger
+	maxAttempts int
+	// maxElapsed bounds the time spent in an operation and its retries, zero meaning no bound.
+	maxElapsed time.Duration
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+// parseRetryPolicy reads the retry policy from the BSL or VSL config.
+func parseRetryPolicy(logger logrus.FieldLogger, config map[string]string) (*retryPolicy, error) {
+	policy := &retryPolicy{
+		log:         logger,
+		maxAttempts: defaultMaxRetryAttempts,
+		baseDelay:   defaultRetryBaseDelay,
+		maxDelay:    defaultRetryMaxDelay,
+	}
+
+	if value := config[maxRetryAttemptsKey]; value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse %s (expected integer)", maxRetryAttemptsKey)
+		}
+		if attempts < 1 {
+			return nil, errors.Errorf("invalid %s %d, expected at least 1 attempt", maxRetryAttemptsKey, attempts)
+		}
+		policy.maxAttempts = attempts
+	}
+
+	maxElapsed, err := parseTimeout(config, maxRetryElapsedKey, defaultMaxRetryElapsed)
+	if err != nil {
+		return nil, err
+	}
+	policy.maxElapsed = maxElapsed
+
+	return policy, nil
+}
+
+// delay returns the time to wait before the attempt following attempt.
+func (p *retryPolicy) delay(attempt int, retryAfter time.Duration) time.Duration {
+	backoff := p.maxDelay
+	if attempt < 32 {
+		backoff = min(p.maxDelay, p.baseDelay<<(attempt-1))
+	}
+	delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+	return max(delay, retryAfter)
+}
+
+// exhausted tells whether waiting delay more would go over the time allowed to the operation.
+func (p *retryPolicy) exhausted(start time.Time, delay time.Duration) bool {
+	return p.maxElapsed > 0 && time.Since(start)+delay > p.maxElapsed
+}
+
+// do calls the Scaleway SDK request fn until it succeeds, fails with an error
+// that is not retryable, or the policy gives up. Requests that are not
+// idempotent are only retried when Scaleway did not process them. The context
+// given to fn records the Retry-After of the response, see retryAfterTransport.
+func (p *retryPolicy) do(name string, idempotent bool, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		var retryAfter time.Duration
+		err := fn(context.WithValue(context.Background(), retryAfterKey{}, &retryAfter))
+		if err == nil || !isRetryableSCWError(err, idempotent) {
+			return err
+		}
+		if attempt >= p.maxAttempts {
+			return errors.Wrapf(err, "%s failed after %d attempts", name, attempt)
+		}
+		delay := p.delay(attempt, retryAfter)
+		if p.exhausted(start, delay) {
+			return errors.Wrapf(err, "%s failed after %d attempts in %s", name, attempt, time.Since(start).Round(time.Millisecond))
+		}
+
+		p.log.WithFields(
+			logrus.Fields{
+				"operation": name,
+				"attempt":   attempt,
+				"delay":     delay,
+				"error":     err,
+			},
+		).Warn("Retrying Scaleway request")
+		time.Sleep(delay)
+	}
+}
+
+// isRetryableSCWError classifies the errors of the Scaleway SDK. Throttled
+// requests and resources in a transient state were not processed and can always
+// be retried, server and network errors only for idempotent requests. The
+// errors of the AWS SDK were already retried by s3Retryer and are not retried
+// again.
+func isRetryableSCWError(err error, idempotent bool) bool {
+	var (
+		responseErr  *scw.ResponseError
+		transientErr *scw.TransientStateError
+		timeoutErr   *TimeoutError
+		netErr       net.Error
+		operationErr *smithy.OperationError
+	)
+	switch {
+	case errors.As(err, &operationErr):
+		return false
+	case errors.As(err, &transientErr):
+		return true
+	case errors.As(err, &responseErr):
+		switch responseErr.StatusCode {
+		case http.StatusTooManyRequests:
+			return true
+		case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return idempotent
+		}
+		return false
+	case errors.As(err, &timeoutErr), errors.As(err, &netErr):
+		return idempotent
+	}
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header, given either in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(0, time.Duration(seconds)*time.Second)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(0, time.Until(date))
+	}
+	return 0
+}
+
+// retryAfterKey is the context key of the Retry-After recorded by retryAfterTransport.
+type retryAfterKey struct{}
+
+// retryAfterTransport records the Retry-After header of the responses in the
+// request context, as the errors of the Scaleway SDK do not carry the headers.
+type retryAfterTransport struct {
+	rt http.RoundTripper
+}
+
+// newRetryAfterHTTPClient returns the HTTP client of the Scaleway SDK clients.
+func newRetryAfterHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &retryAfterTransport{rt: http.DefaultTransport.(*http.Transport).Clone()},
+	}
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if retryAfter, ok := req.Context().Value(retryAfterKey{}).(*time.Duration); ok {
+		*retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return resp, nil
+}
+
+// s3Retryer is the standard retryer of the AWS SDK with the backoff and the
+// attempts of the retry policy. SlowDown and 5xx responses are retryable by default.
+type s3Retryer struct {
+	aws.RetryerV2
+	policy *retryPolicy
+}
+
+func (p *retryPolicy) s3Retryer() aws.Retryer {
+	return &s3Retryer{
+		RetryerV2: retry.NewStandard(func(o *retry.StandardOptions) {
+			o.MaxAttempts = p.maxAttempts
+			o.MaxBackoff = p.maxDelay
+			// the retry quota of the AWS SDK would fail requests early while
+			// Scaleway throttles, the attempts and the elapsed time bound the retries instead.
+			o.RateLimiter = noRetryRateLimit{}
+		}),
+		policy: p,
+	}
+}
+
+// RetryDelay returns the backoff of the policy and logs the retry.
+func (r *s3Retryer) RetryDelay(attempt int, err error) (time.Duration, error) {
+	var retryAfter time.Duration
+	var responseErr *smithyhttp.ResponseError
+	if errors.As(err, &responseErr) && responseErr.Response != nil {
+		retryAfter = parseRetryAfter(responseErr.Response.Header.Get("Retry-After"))
+	}
+	delay := r.policy.delay(attempt, retryAfter)
+
+	r.policy.log.WithFields(
+		logrus.Fields{
+			"attempt": attempt,
+			"delay":   delay,
+			"error":   err,
+		},
+	).Warn("Retrying S3 request")
+	return delay, nil
+}
+
+// noRetryRateLimit is a retry.RateLimiter that never runs out of tokens.
+type noRetryRateLimit struct{}
+
+func (noRetryRateLimit) GetToken(context.Context, uint) (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func (noRetryRateLimit) AddTokens(uint) error { return nil }
+
+// retryStartKey is the stack value holding the start time of an S3 operation.
+type retryStartKey struct{}
+
+// s3RetryMiddlewares stops retrying the S3 operations that went over the
+// maximum elapsed time of the policy.
+func (p *retryPolicy) s3RetryMiddlewares(stack *middleware.Stack) error {
+	if p.maxElapsed <= 0 {
+		return nil
+	}
+
+	err := stack.Initialize.Add(middleware.InitializeMiddlewareFunc("RetryStart",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			return next.HandleInitialize(middleware.WithStackValue(ctx, retryStartKey{}, time.Now()), in)
+		},
+	), middleware.Before)
+	if err != nil {
+		return err
+	}
+
+	// inserted after the retry middleware, so it runs for every attempt
+	return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("RetryElapsed",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			out, metadata, err := next.HandleFinalize(ctx, in)
+			start, ok := middleware.GetStackValue(ctx, retryStartKey{}).(time.Time)
+			if err != nil && ok && p.exhausted(start, 0) {
+				err = &retryElapsedError{elapsed: time.Since(start), err: err}
+			}
+			return out, metadata, err
+		},
+	), "Retry", middleware.After)
+}
+
+// retryElapsedError stops the retries of an operation that took too long.
+type retryElapsedError struct {
+	elapsed time.Duration
+	err     error
+}
+
+func (e *retryElapsedError) Error() string {
+	return "giving up retries after " + e.elapsed.Round(time.Millisecond).String() + ": " + e.err.Error()
+}
+
+func (e *retryElapsedError) Unwrap() error { return e.err }
+
+// RetryableError implements the retry.RetryableError interface.
+func (e *retryElapsedError) RetryableError() bool { return false }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	block "github.com/scaleway/scaleway-sdk-go/api/block/v1alpha1"
+	"github.com/scaleway/scaleway-sdk-go/scw"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRetryPolicy(maxAttempts int, maxElapsed time.Duration) *retryPolicy {
+	return &retryPolicy{
+		log:         newLogger(),
+		maxAttempts: maxAttempts,
+		maxElapsed:  maxElapsed,
+		baseDelay:   time.Millisecond,
+		maxDelay:    5 * time.Millisecond,
+	}
+}
+
+func TestParseRetryPolicy(t *testing.T) {
+	policy, err := parseRetryPolicy(newLogger(), map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, defaultMaxRetryAttempts, policy.maxAttempts)
+	assert.Equal(t, defaultMaxRetryElapsed, policy.maxElapsed)
+
+	policy, err = parseRetryPolicy(newLogger(), map[string]string{maxRetryAttemptsKey: "10", maxRetryElapsedKey: "10m"})
+	require.NoError(t, err)
+	assert.Equal(t, 10, policy.maxAttempts)
+	assert.Equal(t, 10*time.Minute, policy.maxElapsed)
+
+	_, err = parseRetryPolicy(newLogger(), map[string]string{maxRetryAttemptsKey: "0"})
+	assert.EqualError(t, err, "invalid maxRetryAttempts 0, expected at least 1 attempt")
+
+	_, err = parseRetryPolicy(newLogger(), map[string]string{maxRetryAttemptsKey: "many"})
+	assert.Error(t, err)
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := &retryPolicy{baseDelay: time.Second, maxDelay: 4 * time.Second}
+
+	for attempt := 1; attempt < 100; attempt++ {
+		delay := policy.delay(attempt, 0)
+		assert.GreaterOrEqual(t, delay, time.Duration(0))
+		assert.LessOrEqual(t, delay, 4*time.Second)
+	}
+	assert.LessOrEqual(t, policy.delay(1, 0), time.Second)
+	assert.Equal(t, time.Minute, policy.delay(1, time.Minute))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 3*time.Second, parseRetryAfter("3"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("later"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)))
+
+	delay := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.Greater(t, delay, 50*time.Second)
+}
+
+func TestIsRetryableSCWError(t *testing.T) {
+	cases := []struct {
+		name       string
+		err        error
+		idempotent bool
+		retryable  bool
+	}{
+		{"throttled", &scw.ResponseError{StatusCode: http.StatusTooManyRequests}, false, true},
+		{"transient state", &scw.TransientStateError{}, false, true},
+		{"server error", &scw.ResponseError{StatusCode: http.StatusServiceUnavailable}, true, true},
+		{"server error on create", &scw.ResponseError{StatusCode: http.StatusServiceUnavailable}, false, false},
+		{"not found", &scw.ResponseError{StatusCode: http.StatusNotFound}, true, false},
+		{"quotas exceeded", &scw.QuotasExceededError{}, true, false},
+		{"timeout", &TimeoutError{Op: "GetVolume"}, true, true},
+		{"S3 error retried by the AWS SDK", &smithy.OperationError{ServiceID: "S3", OperationName: "HeadObject", Err: &TimeoutError{Op: "HeadObject"}}, true, false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.retryable, isRetryableSCWError(tt.err, tt.idempotent))
+		})
+	}
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	var retryAfter time.Duration
+	ctx := context.WithValue(context.Background(), retryAfterKey{}, &retryAfter)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+
+	resp, err := newRetryAfterHTTPClient().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 7*time.Second, retryAfter)
+}
+
+func TestRetryPolicyDoBlockAPI(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"message":"rate limit exceeded"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"11111111-1111-1111-1111-111111111111"}`))
+	}))
+	defer server.Close()
+
+	client, err := scw.NewClient(
+		scw.WithAPIURL(server.URL),
+		scw.WithAuth(testAccessKey, testSecretKey),
+		scw.WithDefaultZone(scw.ZoneFrPar1),
+		scw.WithHTTPClient(newRetryAfterHTTPClient()),
+	)
+	require.NoError(t, err)
+	blockAPI := block.NewAPI(client)
+
+	var snapshot *block.Snapshot
+	err = newTestRetryPolicy(5, time.Minute).do("CreateSnapshot", false, func(ctx context.Context) (err error) {
+		snapshot, err = blockAPI.CreateSnapshot(&block.CreateSnapshotRequest{VolumeID: "v"}, scw.WithContext(ctx))
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "11111111-1111-1111-1111-111111111111", snapshot.ID)
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestRetryPolicyDoGivesUp(t *testing.T) {
+	var attempts int
+	err := newTestRetryPolicy(3, time.Minute).do("GetVolume", true, func(ctx context.Context) error {
+		attempts++
+		return &scw.ResponseError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+	})
+	assert.EqualError(t, err, "GetVolume failed after 3 attempts: scaleway-sdk-go: http error 503 Service Unavailable")
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = newTestRetryPolicy(3, time.Minute).do("CreateVolume", false, func(ctx context.Context) error {
+		attempts++
+		return &scw.ResponseError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func newTestS3Client(t *testing.T, url string, policy *retryPolicy) *s3.Client {
+	cb := newConfigBuilder(newLogger()).WithRegion("fr-par").WithRetryPolicy(policy)
+	cb.opts = append(cb.opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(testAccessKey, testSecretKey, "")))
+	cfg, err := cb.Build()
+	require.NoError(t, err)
+	client, err := newS3Client(cfg, url, true)
+	require.NoError(t, err)
+	return client
+}
+
+func TestS3RetryerSlowDown(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+			return
+		}
+	}))
+	defer server.Close()
+
+	client := newTestS3Client(t, server.URL, newTestRetryPolicy(5, time.Minute))
+	_, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("key"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestS3RetryerMaxElapsed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+	}))
+	defer server.Close()
+
+	client := newTestS3Client(t, server.URL, newTestRetryPolicy(1000, 50*time.Millisecond))
+	start := time.Now()
+	_, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("key"),
+	})
+	var elapsedErr *retryElapsedError
+	require.ErrorAs(t, err, &elapsedErr)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestS3RequestsHaveASingleRetryLayer(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+	}))
+	defer server.Close()
+
+	policy := newTestRetryPolicy(3, time.Minute)
+	client := newTestS3Client(t, server.URL, policy)
+	// do does not retry the S3 requests the AWS SDK gave up on
+	err := policy.do("HeadObject", true, func(ctx context.Context) error {
+		_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String("bucket"),
+			Key:    aws.String("key"),
+		})
+		return err
+	})
+	require.Error(t, err)
+	assert.Equal(t, int32(3), requests.Load())
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRestoreDays = 1
+	// by default GetObject returns once the restore is requested, as Velero
+	// gives up on downloads long before Glacier restores complete.
+	defaultRestoreTimeout = 0
+	// maxRestoreTimeout bounds the wait of GetObject for a restore.
+	maxRestoreTimeout          = 10 * time.Minute
+	defaultRestorePollInterval = 30 * time.Second
+)
+
+// scwStorageClasses are the storage classes accepted by Scaleway Object Storage.
+var scwStorageClasses = []types.StorageClass{
+	types.StorageClassStandard,
+	types.StorageClassOnezoneIa,
+	types.StorageClassGlacier,
+}
+
+// storageClassOverride applies a storage class to the keys whose base name
+// matches pattern (see path.Match).
+type storageClassOverride struct {
+	pattern      string
+	storageClass types.StorageClass
+}
+
+// parseRestoreTimeout reads the time GetObject waits for the restore of an
+// archived object, at most maxRestoreTimeout.
+func parseRestoreTimeout(config map[string]string) (time.Duration, error) {
+	timeout, err := parseTimeout(config, restoreTimeoutKey, defaultRestoreTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if timeout > maxRestoreTimeout {
+		return 0, errors.Errorf("%s must be at most %s, got %s", restoreTimeoutKey, maxRestoreTimeout, timeout)
+	}
+	return timeout, nil
+}
+
+func parseStorageClass(class string) (types.StorageClass, error) {
+	for _, c := range scwStorageClasses {
+		if string(c) == class {
+			return c, nil
+		}
+	}
+	return "", errors.Errorf("invalid storage class %q, valid storage classes are %v", class, scwStorageClasses)
+}
+
+// parseStorageClassOverrides parses a comma separated list of pattern=CLASS
+// entries, e.g. "*.tar.gz=GLACIER,*-logs.gz=ONEZONE_IA".
+func parseStorageClassOverrides(overrides string) ([]storageClassOverride, error) {
+	var ret []storageClassOverride
+	for _, entry := range strings.Split(overrides, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, class, ok := strings.Cut(entry, "=")
+		if !ok || pattern == "" {
+			return nil, errors.Errorf("invalid %s entry %q, expected pattern=CLASS", storageClassOverridesKey, entry)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s pattern %q", storageClassOverridesKey, pattern)
+		}
+		storageClass, err := parseStorageClass(class)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, storageClassOverride{pattern: pattern, storageClass: storageClass})
+	}
+	return ret, nil
+}
+
+// storageClassFor returns the storage class of key: the first matching
+// override wins, then the default storage class of the BSL.
+func (o *ObjectStore) storageClassFor(key string) types.StorageClass {
+	base := path.Base(key)
+	for _, override := range o.storageClassOverrides {
+		if ok, _ := path.Match(override.pattern, base); ok {
+			return override.storageClass
+		}
+	}
+	return o.storageClass
+}
+
+// restoreArchivedObject asks for an archived object to be restored and waits
+// for it to be readable again for the restore timeout. It returns an
+// ObjectRestoreInProgressError when the object is not restored in time.
+func (o *ObjectStore) restoreArchivedObject(bucket, key string) error {
+	log := o.log.WithFields(
+		logrus.Fields{
+			"bucket": bucket,
+			"key":    key,
+		},
+	)
+
+	log.Info("Object is archived, requesting restore")
+	op := newOperation("RestoreObject", o.metadataTimeout)
+	_, err := o.s3.RestoreObject(op.ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &types.RestoreRequest{
+			Days: aws.Int32(o.restoreDays),
+		},
+	})
+	err = op.wrap(err)
+	op.done()
+	var apiErr smithy.APIError
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.ErrorCode() == "RestoreAlreadyInProgress") {
+		return errors.Wrapf(err, "error restoring archived object %s", key)
+	}
+	if o.restoreTimeout == 0 {
+		return errors.WithStack(&ObjectRestoreInProgressError{Key: key})
+	}
+
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if o.sseCustomerKey != "" {
+		input.SSECustomerAlgorithm = aws.String("AES256")
+		input.SSECustomerKey = &o.sseCustomerKey
+	}
+
+	start := time.Now()
+	for {
+		op := newOperation("HeadObject", o.metadataTimeout)
+		head, err := o.s3.HeadObject(op.ctx, input)
+		err = op.wrap(err)
+		op.done()
+		if err != nil {
+			return errors.Wrapf(err, "error checking restore status of object %s", key)
+		}
+		if restoreCompleted(head) {
+			log.WithField("elapsed", time.Since(start)).Info("Archived object restored")
+			return nil
+		}
+
+		elapsed := time.Since(start)
+		if elapsed >= o.restoreTimeout {
+			return errors.WithStack(&ObjectRestoreInProgressError{Key: key, Waited: elapsed})
+		}
+		log.WithField("elapsed", elapsed).Debug("Waiting for archived object to be restored")
+		time.Sleep(min(o.restorePollInterval, o.restoreTimeout-elapsed))
+	}
+}
+
+// restoreCompleted tells whether a HeadObject output describes a readable object.
+// Scaleway moves restored objects back to STANDARD, S3 reports the restore
+// through the x-amz-restore header.
+func restoreCompleted(head *s3.HeadObjectOutput) bool {
+	if head.Restore != nil {
+		return strings.Contains(*head.Restore, `ongoing-request="false"`)
+	}
+	return head.StorageClass != types.StorageClassGlacier
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	metadataTimeoutKey   = "metadataTimeout"
+	listTimeoutKey       = "listTimeout"
+	uploadTimeoutKey     = "uploadTimeout"
+	downloadTimeoutKey   = "downloadTimeout"
+	streamIdleTimeoutKey = "streamIdleTimeout"
+	blockAPITimeoutKey   = "blockAPITimeout"
+	snapshotTimeoutKey   = "snapshotTimeout"
+	volumeTimeoutKey     = "volumeTimeout"
+
+	defaultMetadataTimeout = time.Minute
+	defaultListTimeout     = 5 * time.Minute
+	// uploads and downloads of large backups are only bounded by the idle
+	// timeout unless a total timeout is configured.
+	defaultUploadTimeout     = 0
+	defaultDownloadTimeout   = 0
+	defaultStreamIdleTimeout = 5 * time.Minute
+	defaultBlockAPITimeout   = 2 * time.Minute
+	// snapshots of large volumes take a while to become available.
+	defaultSnapshotTimeout = time.Hour
+	defaultVolumeTimeout   = 10 * time.Minute
+)
+
+// errIdleTimeout is the cancellation cause of an operation whose streamed
+// body stayed idle for too long.
+var errIdleTimeout = errors.New("idle timeout")
+
+// parseTimeout reads a duration from the config, a zero duration disabling the timeout.
+func parseTimeout(config map[string]string, key string, defaultTimeout time.Duration) (time.Duration, error) {
+	value, ok := config[key]
+	if !ok || value == "" {
+		return defaultTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not parse %s (expected duration)", key)
+	}
+	if timeout < 0 {
+		return 0, errors.Errorf("invalid %s %s, expected a positive duration", key, value)
+	}
+	return timeout, nil
+}
+
+// operation is a single call to Scaleway, bounded by a total timeout.
+type operation struct {
+	name   string
+	start  time.Time
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	stop   context.CancelFunc
+}
+
+// newOperation starts an operation, a zero timeout meaning no deadline.
+func newOperation(name string, timeout time.Duration) *operation {
+	return newOperationContext(context.Background(), name, timeout)
+}
+
+// newOperationContext starts an operation carrying the values of parent.
+func newOperationContext(parent context.Context, name string, timeout time.Duration) *operation {
+	op := &operation{
+		name:  name,
+		start: time.Now(),
+	}
+	ctx, cancel := context.WithCancelCause(parent)
+	op.cancel = cancel
+	op.ctx, op.stop = ctx, func() {}
+	if timeout > 0 {
+		op.ctx, op.stop = context.WithTimeout(ctx, timeout)
+	}
+	return op
+}
+
+// done releases the resources of the operation.
+func (op *operation) done() {
+	op.stop()
+	op.cancel(context.Canceled)
+}
+
+// wrap turns the errors caused by the deadlines of the operation into a TimeoutError.
+func (op *operation) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case errors.Is(context.Cause(op.ctx), errIdleTimeout):
+		return &TimeoutError{Op: op.name, Elapsed: time.Since(op.start), Idle: true}
+	case errors.Is(op.ctx.Err(), context.DeadlineExceeded):
+		return &TimeoutError{Op: op.name, Elapsed: time.Since(op.start)}
+	}
+	return err
+}
+
+// idleReader cancels its operation when no data is read for longer than the
+// idle timeout. It ends the operation when closed.
+type idleReader struct {
+	r     io.Reader
+	op    *operation
+	idle  time.Duration
+	timer *time.Timer
+	once  sync.Once
+}
+
+// newIdleReader wraps the body streamed by op, a zero idle timeout meaning no idle deadline.
+func newIdleReader(r io.Reader, op *operation, idle time.Duration) *idleReader {
+	ir := &idleReader{
+		r:    r,
+		op:   op,
+		idle: idle,
+	}
+	if idle > 0 {
+		ir.timer = time.AfterFunc(idle, func() {
+			op.cancel(errIdleTimeout)
+		})
+	}
+	return ir
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	// a timer that already fired has canceled the operation, leave it stopped
+	if ir.timer != nil && n > 0 && ir.timer.Stop() {
+		ir.timer.Reset(ir.idle)
+	}
+	if err != nil && err != io.EOF {
+		err = ir.op.wrap(err)
+	}
+	return n, err
+}
+
+func (ir *idleReader) Close() error {
+	var err error
+	ir.once.Do(func() {
+		if ir.timer != nil {
+			ir.timer.Stop()
+		}
+		if closer, ok := ir.r.(io.Closer); ok {
+			err = closer.Close()
+		}
+		ir.op.done()
+	})
+	return err
+}
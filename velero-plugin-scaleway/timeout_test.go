@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingBody is a response body that never returns data, like a hung
+// connection. Reads fail once the context of the request is done.
+type blockingBody struct {
+	ctx context.Context
+}
+
+func (b *blockingBody) Read(p []byte) (int, error) {
+	<-b.ctx.Done()
+	return 0, b.ctx.Err()
+}
+
+func (b *blockingBody) Close() error {
+	return nil
+}
+
+func TestParseTimeout(t *testing.T) {
+	timeout, err := parseTimeout(map[string]string{}, metadataTimeoutKey, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, timeout)
+
+	timeout, err = parseTimeout(map[string]string{metadataTimeoutKey: "30s"}, metadataTimeoutKey, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, timeout)
+
+	_, err = parseTimeout(map[string]string{metadataTimeoutKey: "soon"}, metadataTimeoutKey, time.Minute)
+	assert.Error(t, err)
+
+	_, err = parseTimeout(map[string]string{metadataTimeoutKey: "-1s"}, metadataTimeoutKey, time.Minute)
+	assert.EqualError(t, err, "invalid metadataTimeout -1s, expected a positive duration")
+}
+
+func TestObjectExistsTimeout(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	o := &ObjectStore{
+		log:             newLogger(),
+		s3:              s,
+		metadataTimeout: 10 * time.Millisecond,
+	}
+
+	s.On("HeadObject", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	}).Return(&s3.HeadObjectOutput{}, context.DeadlineExceeded)
+
+	_, err := o.ObjectExists("b", "k")
+	require.Error(t, err)
+
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	assert.Equal(t, "HeadObject", timeoutErr.Op)
+	assert.False(t, timeoutErr.Idle)
+	assert.GreaterOrEqual(t, timeoutErr.Elapsed, 10*time.Millisecond)
+	assert.Contains(t, err.Error(), "HeadObject timed out after")
+}
+
+func TestGetObjectIdleTimeout(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	o := &ObjectStore{
+		log:               newLogger(),
+		s3:                s,
+		streamIdleTimeout: 10 * time.Millisecond,
+	}
+
+	body := &blockingBody{}
+	s.On("GetObject", mock.Anything, &s3.GetObjectInput{
+		Bucket: aws.String("b"),
+		Key:    aws.String("k"),
+	}).Run(func(args mock.Arguments) {
+		body.ctx = args.Get(0).(context.Context)
+	}).Return(&s3.GetObjectOutput{Body: body}, nil)
+
+	reader, err := o.GetObject("b", "k")
+	require.NoError(t, err)
+	defer reader.Close()
+
+	_, err = io.ReadAll(reader)
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	assert.Equal(t, "GetObject", timeoutErr.Op)
+	assert.True(t, timeoutErr.Idle)
+}
+
+// slowReader is an upload source producing data slower than the idle timeout,
+// like a backup tarball still being built.
+type slowReader struct {
+	chunks int
+	delay  time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.chunks == 0 {
+		return 0, io.EOF
+	}
+	r.chunks--
+	time.Sleep(r.delay)
+	p[0] = 'x'
+	return 1, nil
+}
+
+func TestPutObjectSlowSourceIsNotIdle(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer server.Close()
+
+	client := newTestS3Client(t, server.URL, newTestRetryPolicy(1, time.Minute))
+	o := &ObjectStore{
+		log:               newLogger(),
+		s3:                client,
+		s3Uploader:        newUploader(client, uploadOptions{partSize: 5 * 1024 * 1024, concurrency: 1, maxParts: 1000}),
+		streamIdleTimeout: 10 * time.Millisecond,
+	}
+
+	require.NoError(t, o.PutObject("bucket", "key", &slowReader{chunks: 3, delay: 30 * time.Millisecond}))
+}
+
+func TestResponseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cb := newConfigBuilder(newLogger()).WithRegion("fr-par").WithResponseTimeout(10 * time.Millisecond).WithRetryPolicy(newTestRetryPolicy(1, time.Minute))
+	cb.opts = append(cb.opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(testAccessKey, testSecretKey, "")))
+	cfg, err := cb.Build()
+	require.NoError(t, err)
+	client, err := newS3Client(cfg, server.URL, true)
+	require.NoError(t, err)
+
+	// the endpoint does not answer, the transport gives up waiting
+	_, err = client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("key"),
+	})
+	assert.ErrorContains(t, err, "timeout awaiting response headers")
+}
+
+func TestResponseTimeoutSparesCompleteMultipartUpload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the endpoint assembles the parts before answering
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, `<CompleteMultipartUploadResult><Key>key</Key></CompleteMultipartUploadResult>`)
+	}))
+	defer server.Close()
+
+	cb := newConfigBuilder(newLogger()).WithRegion("fr-par").WithResponseTimeout(10 * time.Millisecond).WithRetryPolicy(newTestRetryPolicy(1, time.Minute))
+	cb.opts = append(cb.opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(testAccessKey, testSecretKey, "")))
+	cfg, err := cb.Build()
+	require.NoError(t, err)
+	client, err := newS3Client(cfg, server.URL, true)
+	require.NoError(t, err)
+
+	output, err := client.CompleteMultipartUpload(context.Background(), &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String("bucket"),
+		Key:      aws.String("key"),
+		UploadId: aws.String("upload"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "key", aws.ToString(output.Key))
+
+	// the other operations are still bounded
+	_, err = client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("key"),
+	})
+	assert.ErrorContains(t, err, "timeout awaiting response headers")
+}
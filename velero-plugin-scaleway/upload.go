@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	uploadPartSizeKey    = "uploadPartSize"
+	uploadConcurrencyKey = "uploadConcurrency"
+	maxUploadPartsKey    = "maxUploadParts"
+
+	// scwMaxUploadParts and scwMaxUploadPartSize are the multipart upload
+	// limits of Scaleway Object Storage.
+	scwMaxUploadParts    = 1000
+	scwMaxUploadPartSize = 5 * 1024 * 1024 * 1024
+
+	// the default part size allows objects of up to 16GiB with 1000 parts,
+	// while buffering 80MiB with the default concurrency. Raise it for larger
+	// backups.
+	defaultUploadPartSize    = 16 * 1024 * 1024
+	defaultUploadConcurrency = manager.DefaultUploadConcurrency
+	defaultMaxUploadParts    = scwMaxUploadParts
+)
+
+// uploadOptions are the multipart upload settings of PutObject.
+type uploadOptions struct {
+	partSize    int64
+	concurrency int
+	maxParts    int32
+}
+
+// parseUploadOptions reads the multipart upload settings from the BSL config.
+// The part size accepts Kubernetes quantities, e.g. 64Mi.
+func parseUploadOptions(config map[string]string) (uploadOptions, error) {
+	opts := uploadOptions{
+		partSize:    defaultUploadPartSize,
+		concurrency: defaultUploadConcurrency,
+		maxParts:    defaultMaxUploadParts,
+	}
+
+	if value := config[uploadPartSizeKey]; value != "" {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return uploadOptions{}, errors.Wrapf(err, "could not parse %s (expected a size such as 64Mi)", uploadPartSizeKey)
+		}
+		opts.partSize = quantity.Value()
+		if opts.partSize < manager.MinUploadPartSize || opts.partSize > scwMaxUploadPartSize {
+			return uploadOptions{}, errors.Errorf("invalid %s %s, expected a size between 5Mi and 5Gi", uploadPartSizeKey, value)
+		}
+	}
+
+	if value := config[uploadConcurrencyKey]; value != "" {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil || concurrency < 1 {
+			return uploadOptions{}, errors.Errorf("could not parse %s (expected a positive integer): %s", uploadConcurrencyKey, value)
+		}
+		opts.concurrency = concurrency
+	}
+
+	if value := config[maxUploadPartsKey]; value != "" {
+		parts, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || parts < 1 || parts > scwMaxUploadParts {
+			return uploadOptions{}, errors.Errorf("could not parse %s (expected an integer between 1 and %d): %s", maxUploadPartsKey, scwMaxUploadParts, value)
+		}
+		opts.maxParts = int32(parts)
+	}
+
+	return opts, nil
+}
+
+// newUploader returns an uploader with the given settings. Parts of failed
+// uploads are left for PutObject to abort, as the uploader would abort them
+// with the context of the upload, which is done when the upload timed out.
+func newUploader(client manager.UploadAPIClient, opts uploadOptions) *manager.Uploader {
+	return manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = opts.partSize
+		u.Concurrency = opts.concurrency
+		u.MaxUploadParts = opts.maxParts
+		u.LeavePartsOnError = true
+	})
+}
+
+// abortMultipartUpload aborts a failed multipart upload so its parts are not
+// billed as storage. It reports whether the upload was aborted.
+func (o *ObjectStore) abortMultipartUpload(bucket, key, uploadID string) bool {
+	log := o.log.WithFields(
+		logrus.Fields{
+			"bucket":   bucket,
+			"key":      key,
+			"uploadID": uploadID,
+		},
+	)
+
+	op := newOperation("AbortMultipartUpload", o.metadataTimeout)
+	defer op.done()
+
+	_, err := o.s3.AbortMultipartUpload(op.ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		log.WithError(op.wrap(err)).Error("Failed to abort multipart upload, its parts are left in the bucket")
+		return false
+	}
+	log.Info("Aborted multipart upload")
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUploadOptions(t *testing.T) {
+	opts, err := parseUploadOptions(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, uploadOptions{partSize: 16 * 1024 * 1024, concurrency: 5, maxParts: 1000}, opts)
+
+	opts, err = parseUploadOptions(map[string]string{
+		uploadPartSizeKey:    "64Mi",
+		uploadConcurrencyKey: "8",
+		maxUploadPartsKey:    "500",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uploadOptions{partSize: 64 * 1024 * 1024, concurrency: 8, maxParts: 500}, opts)
+
+	for _, config := range []map[string]string{
+		{uploadPartSizeKey: "1Mi"},
+		{uploadPartSizeKey: "6Gi"},
+		{uploadPartSizeKey: "large"},
+		{uploadConcurrencyKey: "0"},
+		{maxUploadPartsKey: "10000"},
+	} {
+		_, err := parseUploadOptions(config)
+		assert.Error(t, err, config)
+	}
+}
+
+func TestPutObjectAbortsFailedMultipartUpload(t *testing.T) {
+	var aborted atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			w.Write([]byte(`<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`))
+		case r.Method == http.MethodPut && query.Has("partNumber"):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`<Error><Code>InvalidRequest</Code><Message>part rejected</Message></Error>`))
+		case r.Method == http.MethodDelete && query.Get("uploadId") == "upload-1":
+			aborted.Add(1)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer server.Close()
+
+	client := newTestS3Client(t, server.URL, newTestRetryPolicy(1, time.Minute))
+	o := &ObjectStore{
+		log:             newLogger(),
+		s3:              client,
+		s3Uploader:      newUploader(client, uploadOptions{partSize: 5 * 1024 * 1024, concurrency: 1, maxParts: 1000}),
+		metadataTimeout: time.Minute,
+	}
+
+	err := o.PutObject("bucket", "key", bytes.NewReader(make([]byte, 6*1024*1024)))
+	assert.ErrorContains(t, err, "error putting object key")
+	assert.Equal(t, int32(1), aborted.Load())
+}
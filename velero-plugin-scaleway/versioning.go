@@ -0,0 +1,175 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxDeleteObjectsKeys is the number of objects accepted by a DeleteObjects request.
+const maxDeleteObjectsKeys = 1000
+
+// objectVersion is a version or a delete marker of a key in a versioned bucket.
+type objectVersion struct {
+	versionID    string
+	lastModified time.Time
+	isLatest     bool
+	deleteMarker bool
+}
+
+// listObjectVersions returns the versions and delete markers of key, oldest first.
+func (o *ObjectStore) listObjectVersions(bucket, key string) ([]objectVersion, error) {
+	op := newOperation("ListObjectVersions", o.listTimeout)
+	defer op.done()
+
+	var ret []objectVersion
+	p := s3.NewListObjectVersionsPaginator(o.s3, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(key),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(op.ctx)
+		if err != nil {
+			return nil, errors.WithStack(op.wrap(err))
+		}
+		// the prefix also matches the keys starting with key
+		for _, v := range page.Versions {
+			if aws.ToString(v.Key) == key {
+				ret = append(ret, objectVersion{
+					versionID:    aws.ToString(v.VersionId),
+					lastModified: aws.ToTime(v.LastModified),
+					isLatest:     aws.ToBool(v.IsLatest),
+				})
+			}
+		}
+		for _, m := range page.DeleteMarkers {
+			if aws.ToString(m.Key) == key {
+				ret = append(ret, objectVersion{
+					versionID:    aws.ToString(m.VersionId),
+					lastModified: aws.ToTime(m.LastModified),
+					isLatest:     aws.ToBool(m.IsLatest),
+					deleteMarker: true,
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].isLatest != ret[j].isLatest {
+			return ret[j].isLatest
+		}
+		return ret[i].lastModified.Before(ret[j].lastModified)
+	})
+	return ret, nil
+}
+
+// deleteAllObjectVersions deletes every version and delete marker of key, so a
+// deleted backup stops consuming storage in a versioned bucket. The older
+// versions are deleted first, in DeleteObjects batches, as they all belong to
+// the key Velero deletes. When one of them is under Object Lock retention, the
+// deletion stops and the latest version of the key is left untouched.
+func (o *ObjectStore) deleteAllObjectVersions(bucket, key string) error {
+	log := o.log.WithFields(
+		logrus.Fields{
+			"bucket": bucket,
+			"key":    key,
+		},
+	)
+
+	versions, err := o.listObjectVersions(bucket, key)
+	if err != nil {
+		return errors.Wrapf(err, "error listing versions of object %s", key)
+	}
+
+	older, latest := versions, []objectVersion(nil)
+	if n := len(versions); n > 0 && versions[n-1].isLatest {
+		older, latest = versions[:n-1], versions[n-1:]
+	}
+	for start := 0; start < len(older); start += maxDeleteObjectsKeys {
+		if err := o.deleteObjectVersions(bucket, key, older[start:min(start+maxDeleteObjectsKeys, len(older))]); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range latest {
+		if err := o.deleteObjectVersion(bucket, key, v.versionID); err != nil {
+			return err
+		}
+		log.WithFields(
+			logrus.Fields{
+				"versionID":    v.versionID,
+				"deleteMarker": v.deleteMarker,
+			},
+		).Debug("Deleted object version")
+	}
+	return nil
+}
+
+// deleteObjectVersions deletes versions of key with a single DeleteObjects
+// request. The outcome of every version is mapped back from the errors of the
+// response, and the error of the oldest version left is returned.
+func (o *ObjectStore) deleteObjectVersions(bucket, key string, versions []objectVersion) error {
+	log := o.log.WithFields(
+		logrus.Fields{
+			"bucket": bucket,
+			"key":    key,
+		},
+	)
+
+	input := &s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &types.Delete{
+			Quiet: aws.Bool(true),
+		},
+	}
+	for _, v := range versions {
+		input.Delete.Objects = append(input.Delete.Objects, types.ObjectIdentifier{
+			Key:       aws.String(key),
+			VersionId: aws.String(v.versionID),
+		})
+	}
+	if alg := o.checksumAlgorithm(); alg != "" {
+		input.ChecksumAlgorithm = alg
+	}
+
+	op := newOperation("DeleteObjects", o.metadataTimeout)
+	output, err := o.s3.DeleteObjects(op.ctx, input)
+	err = op.wrap(err)
+	op.done()
+	if err != nil {
+		return errors.Wrapf(err, "error deleting %d versions of object %s", len(versions), key)
+	}
+
+	failed := make(map[string]types.Error, len(output.Errors))
+	for _, e := range output.Errors {
+		failed[aws.ToString(e.VersionId)] = e
+	}
+	if len(failed) > 1 {
+		log.WithField("versions", len(failed)).Warn("Failed to delete object versions")
+	}
+
+	for _, v := range versions {
+		e, ok := failed[v.versionID]
+		if !ok {
+			log.WithFields(
+				logrus.Fields{
+					"versionID":    v.versionID,
+					"deleteMarker": v.deleteMarker,
+				},
+			).Debug("Deleted object version")
+			continue
+		}
+		versionErr := &smithy.GenericAPIError{Code: aws.ToString(e.Code), Message: aws.ToString(e.Message)}
+		if lockedErr := o.objectLockedError(bucket, key, v.versionID, versionErr); lockedErr != nil {
+			return errors.WithStack(lockedErr)
+		}
+		return errors.Wrapf(versionErr, "error deleting version %s of object %s", v.versionID, key)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func versionedBucketListing(now time.Time) *s3.ListObjectVersionsOutput {
+	return &s3.ListObjectVersionsOutput{
+		Versions: []types.ObjectVersion{
+			{Key: aws.String("k"), VersionId: aws.String("v2"), LastModified: aws.Time(now.Add(-time.Hour))},
+			{Key: aws.String("k"), VersionId: aws.String("v1"), LastModified: aws.Time(now.Add(-2 * time.Hour))},
+			// shares the prefix of k, must not be deleted
+			{Key: aws.String("k2"), VersionId: aws.String("other"), LastModified: aws.Time(now), IsLatest: aws.Bool(true)},
+		},
+		DeleteMarkers: []types.DeleteMarkerEntry{
+			{Key: aws.String("k"), VersionId: aws.String("marker"), LastModified: aws.Time(now), IsLatest: aws.Bool(true)},
+		},
+	}
+}
+
+func TestDeleteObjectAllVersions(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	o := &ObjectStore{
+		log:               newLogger(),
+		s3:                s,
+		deleteAllVersions: true,
+	}
+
+	s.On("ListObjectVersions", mock.Anything, &s3.ListObjectVersionsInput{
+		Bucket: aws.String("b"),
+		Prefix: aws.String("k"),
+	}).Return(versionedBucketListing(time.Now()), nil)
+
+	// the older versions are deleted in a batch, then the latest one
+	s.On("DeleteObjects", mock.Anything, &s3.DeleteObjectsInput{
+		Bucket: aws.String("b"),
+		Delete: &types.Delete{
+			Objects: []types.ObjectIdentifier{
+				{Key: aws.String("k"), VersionId: aws.String("v1")},
+				{Key: aws.String("k"), VersionId: aws.String("v2")},
+			},
+			Quiet: aws.Bool(true),
+		},
+	}).Return(&s3.DeleteObjectsOutput{}, nil).Once()
+	s.On("DeleteObject", mock.Anything, &s3.DeleteObjectInput{
+		Bucket:    aws.String("b"),
+		Key:       aws.String("k"),
+		VersionId: aws.String("marker"),
+	}).Return(&s3.DeleteObjectOutput{}, nil).Once()
+
+	require.NoError(t, o.DeleteObject("b", "k"))
+}
+
+func TestDeleteObjectAllVersionsInBatches(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	o := &ObjectStore{
+		log:               newLogger(),
+		s3:                s,
+		deleteAllVersions: true,
+	}
+
+	now := time.Now()
+	listing := &s3.ListObjectVersionsOutput{}
+	for i := 0; i < maxDeleteObjectsKeys+1; i++ {
+		listing.Versions = append(listing.Versions, types.ObjectVersion{
+			Key:          aws.String("k"),
+			VersionId:    aws.String(fmt.Sprintf("v%d", i)),
+			LastModified: aws.Time(now.Add(time.Duration(i-maxDeleteObjectsKeys-1) * time.Minute)),
+		})
+	}
+	listing.Versions = append(listing.Versions, types.ObjectVersion{
+		Key:          aws.String("k"),
+		VersionId:    aws.String("latest"),
+		LastModified: aws.Time(now),
+		IsLatest:     aws.Bool(true),
+	})
+	s.On("ListObjectVersions", mock.Anything, mock.Anything).Return(listing, nil)
+
+	var batches []int
+	s.On("DeleteObjects", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		input := args.Get(1).(*s3.DeleteObjectsInput)
+		batches = append(batches, len(input.Delete.Objects))
+	}).Return(&s3.DeleteObjectsOutput{}, nil).Twice()
+	s.On("DeleteObject", mock.Anything, &s3.DeleteObjectInput{
+		Bucket:    aws.String("b"),
+		Key:       aws.String("k"),
+		VersionId: aws.String("latest"),
+	}).Return(&s3.DeleteObjectOutput{}, nil).Once()
+
+	require.NoError(t, o.DeleteObject("b", "k"))
+	assert.Equal(t, []int{maxDeleteObjectsKeys, 1}, batches)
+}
+
+func TestDeleteObjectAllVersionsBatchError(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	o := &ObjectStore{
+		log:               newLogger(),
+		s3:                s,
+		deleteAllVersions: true,
+	}
+
+	s.On("ListObjectVersions", mock.Anything, mock.Anything).Return(versionedBucketListing(time.Now()), nil)
+	s.On("DeleteObjects", mock.Anything, mock.Anything).Return(&s3.DeleteObjectsOutput{
+		Errors: []types.Error{
+			{Key: aws.String("k"), VersionId: aws.String("v2"), Code: aws.String("InternalError"), Message: aws.String("try again")},
+		},
+	}, nil).Once()
+
+	// the error of the version is reported, the latest version is kept
+	err := o.DeleteObject("b", "k")
+	assert.EqualError(t, err, "error deleting version v2 of object k: api error InternalError: try again")
+}
+
+func TestDeleteObjectAllVersionsUnderRetention(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+
+	o := &ObjectStore{
+		log:               newLogger(),
+		s3:                s,
+		deleteAllVersions: true,
+	}
+
+	retainUntil := time.Now().Add(24 * time.Hour)
+	s.On("ListObjectVersions", mock.Anything, mock.Anything).Return(versionedBucketListing(time.Now()), nil)
+	s.On("DeleteObjects", mock.Anything, mock.Anything).Return(&s3.DeleteObjectsOutput{
+		Errors: []types.Error{
+			{Key: aws.String("k"), VersionId: aws.String("v1"), Code: aws.String("AccessDenied"), Message: aws.String("Access Denied")},
+		},
+	}, nil).Once()
+	s.On("GetObjectRetention", mock.Anything, &s3.GetObjectRetentionInput{
+		Bucket:    aws.String("b"),
+		Key:       aws.String("k"),
+		VersionId: aws.String("v1"),
+	}).Return(&s3.GetObjectRetentionOutput{
+		Retention: &types.ObjectLockRetention{Mode: types.ObjectLockRetentionModeGovernance, RetainUntilDate: aws.Time(retainUntil)},
+	}, nil)
+
+	// the deletion stops at the locked version, the latest one is kept
+	err := o.DeleteObject("b", "k")
+	var lockedErr *ObjectLockedError
+	require.True(t, errors.As(err, &lockedErr))
+	assert.Equal(t, "v1", lockedErr.VersionID)
+	assert.Contains(t, err.Error(), "version v1 of object k is retained until ")
+}
@@ -20,14 +20,17 @@ import (
 	"context"
 
 	"fmt"
+	"net/http"
 	"os"
-	"regexp"
+	"slices"
 	"strings"
+	"time"
 
-	"github.com/aws/smithy-go"
 	"github.com/pkg/errors"
 	block "github.com/scaleway/scaleway-sdk-go/api/block/v1alpha1"
+	"github.com/scaleway/scaleway-sdk-go/api/instance/v1"
 	"github.com/scaleway/scaleway-sdk-go/scw"
+	"github.com/scaleway/scaleway-sdk-go/validation"
 	"github.com/sirupsen/logrus"
 	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/framework"
 	v1 "k8s.io/api/core/v1"
@@ -38,118 +41,214 @@ import (
 const (
 	regionKey    = "region"
 	sbsCSIDriver = "sbs-default.csi.scaleway.com"
+
+	defaultPollInterval = 5 * time.Second
 )
 
 type VolumeSnapshotter struct {
-	log logrus.FieldLogger
-	scw *scw.Client
+	log             logrus.FieldLogger
+	scw             *scwClientReloader
+	region          scw.Region
+	blockAPITimeout time.Duration
+	retry           *retryPolicy
+
+	snapshotTimeout time.Duration
+	volumeTimeout   time.Duration
+	pollInterval    time.Duration
+
+	// block and instance replace the API clients built from the current
+	// credentials in tests.
+	block    blockInterface
+	instance instanceInterface
+}
+
+// volumeBackend snapshots and restores the volumes of a CSI driver. The IDs of
+// its volumes and snapshots are stored by Velero with its prefix, so that a
+// backup can hold the volumes of several drivers.
+type volumeBackend interface {
+	idPrefix() string
+	getVolumeInfo(volumeID zonedID, hint scw.Zone) (string, *int64, error)
+	createSnapshot(volumeID zonedID, snapshotName string, tags []string) (zonedID, error)
+	createVolumeFromSnapshot(snapshotID zonedID, volumeAZ string, iops uint32) (zonedID, error)
+	deleteSnapshot(snapshotID zonedID) error
 }
 
 func newVolumeSnapshotter(logger logrus.FieldLogger) *VolumeSnapshotter {
-	return &VolumeSnapshotter{log: logger}
+	return &VolumeSnapshotter{
+		log:          logger,
+		pollInterval: defaultPollInterval,
+	}
 }
 
 func (s *VolumeSnapshotter) Init(config map[string]string) error {
-	if err := veleroplugin.ValidateVolumeSnapshotterConfigKeys(config, regionKey, credentialProfileKey, configPathKey); err != nil {
+	if err := veleroplugin.ValidateVolumeSnapshotterConfigKeys(config, regionKey, credentialProfileKey, configPathKey, credentialsFileKey, credentialsDirKey, blockAPITimeoutKey, snapshotTimeoutKey, volumeTimeoutKey, maxRetryAttemptsKey, maxRetryElapsedKey); err != nil {
+		return err
+	}
+
+	blockAPITimeout, err := parseTimeout(config, blockAPITimeoutKey, defaultBlockAPITimeout)
+	if err != nil {
+		return err
+	}
+	snapshotTimeout, err := parseTimeout(config, snapshotTimeoutKey, defaultSnapshotTimeout)
+	if err != nil {
+		return err
+	}
+	volumeTimeout, err := parseTimeout(config, volumeTimeoutKey, defaultVolumeTimeout)
+	if err != nil {
+		return err
+	}
+	retries, err := parseRetryPolicy(s.log, config)
+	if err != nil {
 		return err
 	}
 
 	region := config[regionKey]
 	configPath := config[configPathKey]
 	profileName := config[credentialProfileKey]
+	credentialsFile := config[credentialsFileKey]
+	credentialsDir := config[credentialsDirKey]
 
 	if region == "" {
 		return errors.Errorf("missing %s in scw configuration", regionKey)
 	}
-	client, err := newClientBuilder(s.log).WithUserAgent(userAgentPrefix).WithEnvProfile().WithRegion(region).Build(configPath, profileName)
+	if !validation.IsRegion(region) {
+		return errors.Errorf("invalid %s %q", regionKey, region)
+	}
+	chain, err := NewScalewayCredentialsChain(s.log, credentialsFile, configPath, profileName, credentialsDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	client, err := newClientBuilder(s.log).WithUserAgent(userAgentPrefix).WithEnvProfile().WithRegion(region).WithRetryAfter().WithCredentialsChain(chain).BuildReloading(configPath, profileName)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
 	s.scw = client
+	s.region = scw.Region(region)
+	s.blockAPITimeout = blockAPITimeout
+	s.snapshotTimeout = snapshotTimeout
+	s.volumeTimeout = volumeTimeout
+	s.retry = retries
 	return nil
 }
 
-func (s *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeAZ string, iops uint32) (volumeID string, err error) {
-	// describe the snapshot, so we can apply its tags to the volume
-	blockAPI := block.NewAPI(s.scw)
-	getSnapOutput, err := blockAPI.GetSnapshot(&block.GetSnapshotRequest{
-		Zone:       scw.Zone(volumeAZ),
-		SnapshotID: snapshotID,
-	}, scw.WithContext(context.Background()))
+// blockAPI returns a Block API client authenticated with the current credentials.
+func (s *VolumeSnapshotter) blockAPI() (blockInterface, error) {
+	if s.block != nil {
+		return s.block, nil
+	}
+	client, err := s.scw.Client(context.Background())
 	if err != nil {
-		s.log.Infof("failed to describe snap shot: %v", err)
-
-		return "", errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
+	return block.NewAPI(client), nil
+}
 
-	if getSnapOutput != nil {
-		return "", errors.Errorf("expected snapshot from GetSnapshot for %s", snapshotID)
+// instanceAPI returns an Instance API client authenticated with the current credentials.
+func (s *VolumeSnapshotter) instanceAPI() (instanceInterface, error) {
+	if s.instance != nil {
+		return s.instance, nil
 	}
-
-	// filter tags through getTagsForCluster() function in order to apply
-	// proper ownership tags to restored volumes
-	input := &block.CreateVolumeRequest{
-		FromSnapshot: &block.CreateVolumeRequestFromSnapshot{
-			SnapshotID: snapshotID,
-		},
-		Zone:     scw.Zone(volumeAZ),
-		PerfIops: scw.Uint32Ptr(iops),
+	client, err := s.scw.Client(context.Background())
+	if err != nil {
+		return nil, errors.WithStack(err)
 	}
+	return instance.NewAPI(client), nil
+}
 
-	if len(getSnapOutput.Tags) > 0 {
-		input.Tags = getTagsForCluster(getSnapOutput.Tags)
+// backendForDriver returns the backend of the volumes of a CSI driver.
+func (s *VolumeSnapshotter) backendForDriver(driver string) (volumeBackend, bool) {
+	switch driver {
+	case sbsCSIDriver:
+		return &sbsVolumes{s: s}, true
+	case instanceCSIDriver:
+		return &instanceVolumes{s: s}, true
 	}
+	return nil, false
+}
 
-	output, err := blockAPI.CreateVolume(input, scw.WithContext(context.Background()))
+// parseID returns the backend and the zoned ID of a volume or snapshot ID
+// stored by Velero.
+func (s *VolumeSnapshotter) parseID(id string) (volumeBackend, zonedID, error) {
+	var backend volumeBackend = &sbsVolumes{s: s}
+	if rest, ok := strings.CutPrefix(id, instanceIDPrefix); ok {
+		backend, id = &instanceVolumes{s: s}, rest
+	}
+	parsed, err := parseZonedID(id)
 	if err != nil {
-		return "", errors.WithStack(err)
+		return nil, zonedID{}, err
 	}
+	return backend, parsed, nil
+}
 
-	return output.ID, nil
+// call runs a Block API request with the retry policy, every attempt being
+// bounded by the Block API timeout.
+func (s *VolumeSnapshotter) call(name string, idempotent bool, fn func(opt scw.RequestOption) error) error {
+	return s.retry.do(name, idempotent, func(ctx context.Context) error {
+		op := newOperationContext(ctx, name, s.blockAPITimeout)
+		defer op.done()
+		return op.wrap(fn(scw.WithContext(op.ctx)))
+	})
 }
 
-func (s *VolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
-	volumeInfo, err := s.describeVolume(volumeID)
-	if err != nil {
-		return "", nil, err
+// callInZone runs a Block API request on a resource in its zone. The zone of
+// IDs returned before the IDs were zoned is unknown, so the request is tried
+// in every zone of the region, starting with hint, until the resource is
+// found. It returns the zone of the resource.
+func (s *VolumeSnapshotter) callInZone(name string, idempotent bool, id zonedID, hint scw.Zone, fn func(zone scw.Zone, opt scw.RequestOption) error) (scw.Zone, error) {
+	if id.zone != "" {
+		if region, err := id.zone.Region(); err != nil || region != s.region {
+			return "", errors.Errorf("zone %s of %s is not in region %s", id.zone, id, s.region)
+		}
+		return id.zone, s.call(name, idempotent, func(opt scw.RequestOption) error {
+			return fn(id.zone, opt)
+		})
 	}
 
-	var (
-		volumeType string
-		iops64     int64
-	)
-
-	volumeType = volumeInfo.Type
-
-	if volumeInfo.Specs != nil {
-		specs := volumeInfo.Specs
-		iops32 := specs.PerfIops
-		iops64 = int64(*iops32)
+	zones := s.region.GetZones()
+	if i := slices.Index(zones, hint); i > 0 {
+		zones = slices.Concat([]scw.Zone{hint}, zones[:i], zones[i+1:])
 	}
-
-	return volumeType, &iops64, nil
+	var err error
+	for _, zone := range zones {
+		err = s.call(name, idempotent, func(opt scw.RequestOption) error {
+			return fn(zone, opt)
+		})
+		if !isNotFound(err) {
+			return zone, err
+		}
+		s.log.WithFields(logrus.Fields{"id": id.id, "zone": zone}).Debug("Resource not found in zone")
+	}
+	return "", errors.Wrapf(err, "%s not found in region %s", id, s.region)
 }
 
-func (s *VolumeSnapshotter) describeVolume(volumeID string) (block.Volume, error) {
-	blockAPI := block.NewAPI(s.scw)
+// isNotFound tells whether a Scaleway API request failed as the resource does not exist.
+func isNotFound(err error) bool {
+	var notFound *scw.ResourceNotFoundError
+	var respErr *scw.ResponseError
+	return errors.As(err, &notFound) || (errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound)
+}
 
-	input := &block.GetVolumeRequest{
-		VolumeID: volumeID,
+// CreateVolumeFromSnapshot restores a snapshot to a new volume of the same
+// driver.
+func (s *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeAZ string, iops uint32) (volumeID string, err error) {
+	backend, snapshot, err := s.parseID(snapshotID)
+	if err != nil {
+		return "", err
 	}
-
-	output, err := blockAPI.GetVolume(input, scw.WithContext(context.Background()))
+	volume, err := backend.createVolumeFromSnapshot(snapshot, volumeAZ, iops)
 	if err != nil {
-		s.log.Infof("failed to describe snap shot: %v", err)
-
-		return block.Volume{}, errors.WithStack(err)
+		return "", err
 	}
+	return backend.idPrefix() + volume.String(), nil
+}
 
-	if output == nil {
-		return block.Volume{}, errors.Errorf("Expected one volume from DescribeVolumes for volume ID %v", volumeID)
+func (s *VolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
+	backend, volume, err := s.parseID(volumeID)
+	if err != nil {
+		return "", nil, err
 	}
-
-	return *output, nil
+	return backend.getVolumeInfo(volume, scw.Zone(volumeAZ))
 }
 
 type tags []string
@@ -180,29 +279,57 @@ func toTags(strSlice []string) tags {
 }
 
 func (s *VolumeSnapshotter) CreateSnapshot(volumeID, snapshotName string, tags []string) (string, error) {
-	// describe the volume, so we can copy its tags to the snapshot
-	volumeInfo, err := s.describeVolume(volumeID)
+	backend, volume, err := s.parseID(volumeID)
+	if err != nil {
+		return "", err
+	}
+	snapshot, err := backend.createSnapshot(volume, snapshotName, tags)
 	if err != nil {
 		return "", err
 	}
+	return backend.idPrefix() + snapshot.String(), nil
+}
 
-	blockAPI := block.NewAPI(s.scw)
+// waitForStatus polls the status of a volume or a snapshot with the request
+// name until it is available, failing when it ends in error or the timeout
+// elapses.
+func (s *VolumeSnapshotter) waitForStatus(name, kind string, id zonedID, timeout time.Duration, available, failed string, getStatus func(opt scw.RequestOption) (string, error)) error {
+	log := s.log.WithField(kind, id)
+
+	start := time.Now()
+	var status string
+	for {
+		var current string
+		err := s.call(name, true, func(opt scw.RequestOption) (err error) {
+			current, err = getStatus(opt)
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error checking status of %s %s", kind, id)
+		}
 
-	tagsFromVolume := toTags(volumeInfo.Tags)
-	tagsMerged := tagsFromVolume.merge(tags)
-	input := &block.CreateSnapshotRequest{
-		VolumeID: volumeInfo.ID,
-		Tags:     tagsMerged,
-		Zone:     volumeInfo.Zone,
-		Name:     fmt.Sprintf("vol-%s-snap-%s", volumeInfo.Name, snapshotName),
-	}
+		if current != status {
+			status = current
+			log.WithFields(
+				logrus.Fields{
+					"status":  status,
+					"elapsed": time.Since(start).Round(time.Second),
+				},
+			).Infof("Status of %s changed", kind)
+		}
+		switch status {
+		case available:
+			return nil
+		case failed:
+			return errors.Errorf("%s %s failed", kind, id)
+		}
 
-	res, err := blockAPI.CreateSnapshot(input, scw.WithContext(context.Background()))
-	if err != nil {
-		return "", errors.WithStack(err)
+		if timeout > 0 && time.Since(start) >= timeout {
+			return errors.Errorf("timed out after %s waiting for %s %s to be available, last status %s", timeout, kind, id, status)
+		}
+		log.WithField("elapsed", time.Since(start)).Debugf("Waiting for %s to be available", kind)
+		time.Sleep(s.pollInterval)
 	}
-
-	return res.ID, nil
 }
 
 func getTagsForCluster(snapshotTags []string) []string {
@@ -229,32 +356,13 @@ func getTagsForCluster(snapshotTags []string) []string {
 }
 
 func (s *VolumeSnapshotter) DeleteSnapshot(snapshotID string) error {
-	blockAPI := block.NewAPI(s.scw)
-
-	input := &block.DeleteSnapshotRequest{
-		SnapshotID: snapshotID,
-	}
-
-	err := blockAPI.DeleteSnapshot(input, scw.WithContext(context.Background()))
-
-	// if it's a NotFound error, we don't need to return an error
-	// since the snapshot is not there.
-	var apiErr smithy.APIError
-	if errors.As(err, &apiErr) {
-		if "InvalidSnapshot.NotFound" == apiErr.ErrorCode() {
-			return nil
-		}
-	}
-
+	backend, snapshot, err := s.parseID(snapshotID)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
-
-	return nil
+	return backend.deleteSnapshot(snapshot)
 }
 
-var ebsVolumeIDRegex = regexp.MustCompile("vol-.*")
-
 func (s *VolumeSnapshotter) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error) {
 	pv := new(v1.PersistentVolume)
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredPV.UnstructuredContent(), pv); err != nil {
@@ -262,8 +370,12 @@ func (s *VolumeSnapshotter) GetVolumeID(unstructuredPV runtime.Unstructured) (st
 	}
 	if pv.Spec.CSI != nil {
 		driver := pv.Spec.CSI.Driver
-		if driver == sbsCSIDriver {
-			return ebsVolumeIDRegex.FindString(pv.Spec.CSI.VolumeHandle), nil
+		if backend, ok := s.backendForDriver(driver); ok {
+			handle, err := parseZonedID(pv.Spec.CSI.VolumeHandle)
+			if err != nil {
+				return "", errors.Wrapf(err, "invalid volume handle of PV %s", pv.Name)
+			}
+			return backend.idPrefix() + handle.String(), nil
 		}
 		s.log.Infof("Unable to handle CSI driver: %s", driver)
 	}
@@ -279,8 +391,19 @@ func (s *VolumeSnapshotter) SetVolumeID(unstructuredPV runtime.Unstructured, vol
 	if pv.Spec.CSI != nil {
 		// PV is provisioned by CSI driver
 		driver := pv.Spec.CSI.Driver
-		if driver == sbsCSIDriver {
-			pv.Spec.CSI.VolumeHandle = volumeID
+		if expected, ok := s.backendForDriver(driver); ok {
+			backend, handle, err := s.parseID(volumeID)
+			if err != nil {
+				return nil, err
+			}
+			if backend.idPrefix() != expected.idPrefix() {
+				return nil, errors.Errorf("volume %s cannot be set on a PV of CSI driver %s", volumeID, driver)
+			}
+			// keep the zone of the current handle when the volume ID has none
+			if current, err := parseZonedID(pv.Spec.CSI.VolumeHandle); handle.zone == "" && err == nil {
+				handle.zone = current.zone
+			}
+			pv.Spec.CSI.VolumeHandle = handle.String()
 		} else {
 			return nil, fmt.Errorf("unable to handle CSI driver: %s", driver)
 		}
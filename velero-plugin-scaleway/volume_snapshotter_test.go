@@ -19,9 +19,13 @@ package main
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
+	block "github.com/scaleway/scaleway-sdk-go/api/block/v1alpha1"
+	"github.com/scaleway/scaleway-sdk-go/scw"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -40,13 +44,73 @@ func TestGetVolumeIDForCSI(t *testing.T) {
 		wantErr bool
 	}{
 		{
-			name: "scw CSI driver",
+			name: "zoned handle",
+			csiJSON: `{
+				"driver": "sbs-default.csi.scaleway.com",
+				"fsType": "ext4",
+				"volumeHandle": "fr-par-1/11111111-1111-1111-1111-111111111111"
+			}`,
+			want:    "fr-par-1/11111111-1111-1111-1111-111111111111",
+			wantErr: false,
+		},
+		{
+			name: "bare UUID handle",
+			csiJSON: `{
+				"driver": "sbs-default.csi.scaleway.com",
+				"fsType": "ext4",
+				"volumeHandle": "11111111-1111-1111-1111-111111111111"
+			}`,
+			want:    "11111111-1111-1111-1111-111111111111",
+			wantErr: false,
+		},
+		{
+			name: "uppercase UUID handle",
+			csiJSON: `{
+				"driver": "sbs-default.csi.scaleway.com",
+				"fsType": "ext4",
+				"volumeHandle": "nl-ams-2/AAAAAAAA-1111-1111-1111-111111111111"
+			}`,
+			want:    "nl-ams-2/aaaaaaaa-1111-1111-1111-111111111111",
+			wantErr: false,
+		},
+		{
+			name: "EBS handle",
 			csiJSON: `{
 				"driver": "sbs-default.csi.scaleway.com",
 				"fsType": "ext4",
 				"volumeHandle": "vol-0866e1c99bd130a2c"
 			}`,
-			want:    "vol-0866e1c99bd130a2c",
+			want:    "",
+			wantErr: true,
+		},
+		{
+			name: "region instead of zone",
+			csiJSON: `{
+				"driver": "sbs-default.csi.scaleway.com",
+				"fsType": "ext4",
+				"volumeHandle": "fr-par/11111111-1111-1111-1111-111111111111"
+			}`,
+			want:    "",
+			wantErr: true,
+		},
+		{
+			name: "extra path segment",
+			csiJSON: `{
+				"driver": "sbs-default.csi.scaleway.com",
+				"fsType": "ext4",
+				"volumeHandle": "fr-par-1/11111111-1111-1111-1111-111111111111/snapshot"
+			}`,
+			want:    "",
+			wantErr: true,
+		},
+		{
+			name: "legacy Instance volume handle",
+			csiJSON: `{
+				"driver": "csi.scaleway.com",
+				"fsType": "ext4",
+				"volumeHandle": "fr-par-1/11111111-1111-1111-1111-111111111111"
+			}`,
+			want:    "instance:fr-par-1/11111111-1111-1111-1111-111111111111",
 			wantErr: false,
 		},
 		{
@@ -87,20 +151,95 @@ func TestSetVolumeIDForCSI(t *testing.T) {
 	}
 
 	cases := []struct {
-		name     string
-		csiJSON  string
-		volumeID string
-		wantErr  bool
+		name       string
+		csiJSON    string
+		volumeID   string
+		wantHandle string
+		wantErr    bool
 	}{
 		{
-			name: "set ID to CSI with scw SBS CSI driver",
+			name: "zoned volume ID",
 			csiJSON: `{
 				"driver": "sbs-default.csi.scaleway.com",
 				"fsType": "ext4",
-				"volumeHandle": "vol-0866e1c99bd130a2c"
+				"volumeHandle": "fr-par-1/11111111-1111-1111-1111-111111111111"
+			}`,
+			volumeID:   "fr-par-2/22222222-2222-2222-2222-222222222222",
+			wantHandle: "fr-par-2/22222222-2222-2222-2222-222222222222",
+			wantErr:    false,
+		},
+		{
+			name: "bare volume ID keeps the zone of the handle",
+			csiJSON: `{
+				"driver": "sbs-default.csi.scaleway.com",
+				"fsType": "ext4",
+				"volumeHandle": "fr-par-1/11111111-1111-1111-1111-111111111111"
+			}`,
+			volumeID:   "22222222-2222-2222-2222-222222222222",
+			wantHandle: "fr-par-1/22222222-2222-2222-2222-222222222222",
+			wantErr:    false,
+		},
+		{
+			name: "bare volume ID on a bare handle",
+			csiJSON: `{
+				"driver": "sbs-default.csi.scaleway.com",
+				"fsType": "ext4",
+				"volumeHandle": "11111111-1111-1111-1111-111111111111"
+			}`,
+			volumeID:   "22222222-2222-2222-2222-222222222222",
+			wantHandle: "22222222-2222-2222-2222-222222222222",
+			wantErr:    false,
+		},
+		{
+			name: "invalid volume ID",
+			csiJSON: `{
+				"driver": "sbs-default.csi.scaleway.com",
+				"fsType": "ext4",
+				"volumeHandle": "fr-par-1/11111111-1111-1111-1111-111111111111"
 			}`,
 			volumeID: "vol-abcd",
-			wantErr:  false,
+			wantErr:  true,
+		},
+		{
+			name: "legacy Instance volume ID",
+			csiJSON: `{
+				"driver": "csi.scaleway.com",
+				"fsType": "ext4",
+				"volumeHandle": "fr-par-1/11111111-1111-1111-1111-111111111111"
+			}`,
+			volumeID:   "instance:fr-par-1/22222222-2222-2222-2222-222222222222",
+			wantHandle: "fr-par-1/22222222-2222-2222-2222-222222222222",
+			wantErr:    false,
+		},
+		{
+			name: "Instance volume ID on an SBS PV",
+			csiJSON: `{
+				"driver": "sbs-default.csi.scaleway.com",
+				"fsType": "ext4",
+				"volumeHandle": "fr-par-1/11111111-1111-1111-1111-111111111111"
+			}`,
+			volumeID: "instance:fr-par-1/22222222-2222-2222-2222-222222222222",
+			wantErr:  true,
+		},
+		{
+			name: "SBS volume ID on an Instance PV",
+			csiJSON: `{
+				"driver": "csi.scaleway.com",
+				"fsType": "ext4",
+				"volumeHandle": "fr-par-1/11111111-1111-1111-1111-111111111111"
+			}`,
+			volumeID: "fr-par-1/22222222-2222-2222-2222-222222222222",
+			wantErr:  true,
+		},
+		{
+			name: "unknown csi driver",
+			csiJSON: `{
+				"driver": "unknown.drv.com",
+				"fsType": "ext4",
+				"volumeHandle": "fr-par-1/11111111-1111-1111-1111-111111111111"
+			}`,
+			volumeID: "fr-par-1/22222222-2222-2222-2222-222222222222",
+			wantErr:  true,
 		},
 	}
 	for _, tt := range cases {
@@ -120,8 +259,333 @@ func TestSetVolumeIDForCSI(t *testing.T) {
 				assert.NoError(t, err)
 				newPV := new(v1.PersistentVolume)
 				require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(newRes.UnstructuredContent(), newPV))
-				assert.Equal(t, tt.volumeID, newPV.Spec.CSI.VolumeHandle)
+				assert.Equal(t, tt.wantHandle, newPV.Spec.CSI.VolumeHandle)
+			}
+		})
+	}
+}
+
+type mockBlock struct {
+	mock.Mock
+}
+
+func (m *mockBlock) GetVolume(req *block.GetVolumeRequest, opts ...scw.RequestOption) (*block.Volume, error) {
+	args := m.Called(req)
+	return args.Get(0).(*block.Volume), args.Error(1)
+}
+
+func (m *mockBlock) CreateVolume(req *block.CreateVolumeRequest, opts ...scw.RequestOption) (*block.Volume, error) {
+	args := m.Called(req)
+	return args.Get(0).(*block.Volume), args.Error(1)
+}
+
+func (m *mockBlock) GetSnapshot(req *block.GetSnapshotRequest, opts ...scw.RequestOption) (*block.Snapshot, error) {
+	args := m.Called(req)
+	return args.Get(0).(*block.Snapshot), args.Error(1)
+}
+
+func (m *mockBlock) CreateSnapshot(req *block.CreateSnapshotRequest, opts ...scw.RequestOption) (*block.Snapshot, error) {
+	args := m.Called(req)
+	return args.Get(0).(*block.Snapshot), args.Error(1)
+}
+
+func (m *mockBlock) DeleteSnapshot(req *block.DeleteSnapshotRequest, opts ...scw.RequestOption) error {
+	args := m.Called(req)
+	return args.Error(0)
+}
+
+func (m *mockBlock) DeleteVolume(req *block.DeleteVolumeRequest, opts ...scw.RequestOption) error {
+	args := m.Called(req)
+	return args.Error(0)
+}
+
+const (
+	testVolumeID   = "11111111-1111-1111-1111-111111111111"
+	testSnapshotID = "22222222-2222-2222-2222-222222222222"
+)
+
+func newTestVolumeSnapshotter(b *mockBlock) *VolumeSnapshotter {
+	return &VolumeSnapshotter{
+		log:             newLogger(),
+		region:          scw.RegionFrPar,
+		blockAPITimeout: time.Minute,
+		retry:           newTestRetryPolicy(1, time.Minute),
+		block:           b,
+
+		snapshotTimeout: time.Minute,
+		volumeTimeout:   time.Minute,
+		pollInterval:    time.Millisecond,
+	}
+}
+
+func TestDeleteSnapshotInZone(t *testing.T) {
+	notFound := &scw.ResourceNotFoundError{Resource: "snapshot", ResourceID: testSnapshotID}
+
+	tests := []struct {
+		name          string
+		snapshotID    string
+		zones         map[scw.Zone]error
+		expectedError string
+	}{
+		{
+			name:       "zoned ID",
+			snapshotID: "fr-par-2/" + testSnapshotID,
+			zones:      map[scw.Zone]error{scw.ZoneFrPar2: nil},
+		},
+		{
+			name:       "legacy ID",
+			snapshotID: testSnapshotID,
+			zones:      map[scw.Zone]error{scw.ZoneFrPar1: notFound, scw.ZoneFrPar2: nil},
+		},
+		{
+			name:       "legacy ID of a deleted snapshot",
+			snapshotID: testSnapshotID,
+			zones:      map[scw.Zone]error{scw.ZoneFrPar1: notFound, scw.ZoneFrPar2: notFound, scw.ZoneFrPar3: notFound},
+		},
+		{
+			name:          "zone of another region",
+			snapshotID:    "nl-ams-1/" + testSnapshotID,
+			expectedError: "zone nl-ams-1 of nl-ams-1/" + testSnapshotID + " is not in region fr-par",
+		},
+		{
+			name:          "invalid ID",
+			snapshotID:    "snap-0866e1c99bd130a2c",
+			expectedError: `invalid ID "snap-0866e1c99bd130a2c": "snap-0866e1c99bd130a2c" is not a UUID`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := new(mockBlock)
+			defer b.AssertExpectations(t)
+			for zone, err := range tc.zones {
+				b.On("DeleteSnapshot", &block.DeleteSnapshotRequest{Zone: zone, SnapshotID: testSnapshotID}).Return(err).Once()
+			}
+
+			err := newTestVolumeSnapshotter(b).DeleteSnapshot(tc.snapshotID)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestGetVolumeInfoLooksUpLegacyIDsInHintFirst(t *testing.T) {
+	b := new(mockBlock)
+	defer b.AssertExpectations(t)
+
+	b.On("GetVolume", &block.GetVolumeRequest{Zone: scw.ZoneFrPar3, VolumeID: testVolumeID}).Return(&block.Volume{
+		ID:    testVolumeID,
+		Zone:  scw.ZoneFrPar3,
+		Type:  "sbs_5k",
+		Specs: &block.VolumeSpecifications{PerfIops: scw.Uint32Ptr(5000)},
+	}, nil).Once()
+
+	volumeType, iops, err := newTestVolumeSnapshotter(b).GetVolumeInfo(testVolumeID, "fr-par-3")
+	require.NoError(t, err)
+	assert.Equal(t, "sbs_5k", volumeType)
+	assert.Equal(t, int64(5000), *iops)
+}
+
+func TestCreateSnapshotReturnsZonedID(t *testing.T) {
+	b := new(mockBlock)
+	defer b.AssertExpectations(t)
+
+	b.On("GetVolume", &block.GetVolumeRequest{Zone: scw.ZoneFrPar2, VolumeID: testVolumeID}).Return(&block.Volume{
+		ID:   testVolumeID,
+		Name: "pvc-1",
+		Zone: scw.ZoneFrPar2,
+		Tags: []string{"cluster"},
+	}, nil).Once()
+	b.On("CreateSnapshot", &block.CreateSnapshotRequest{
+		Zone:     scw.ZoneFrPar2,
+		VolumeID: testVolumeID,
+		Name:     "vol-pvc-1-snap-backup",
+		Tags:     []string{"cluster", "velero"},
+	}).Return(&block.Snapshot{ID: testSnapshotID, Zone: scw.ZoneFrPar2, Status: block.SnapshotStatusCreating}, nil).Once()
+	getSnapshot := &block.GetSnapshotRequest{Zone: scw.ZoneFrPar2, SnapshotID: testSnapshotID}
+	b.On("GetSnapshot", getSnapshot).Return(&block.Snapshot{Status: block.SnapshotStatusCreating}, nil).Twice()
+	b.On("GetSnapshot", getSnapshot).Return(&block.Snapshot{Status: block.SnapshotStatusAvailable}, nil).Once()
+
+	snapshotID, err := newTestVolumeSnapshotter(b).CreateSnapshot("fr-par-2/"+testVolumeID, "backup", []string{"velero"})
+	require.NoError(t, err)
+	assert.Equal(t, "fr-par-2/"+testSnapshotID, snapshotID)
+}
+
+func TestCreateSnapshotFailure(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        block.SnapshotStatus
+		timeout       time.Duration
+		expectedError string
+	}{
+		{
+			name:          "snapshot in error",
+			status:        block.SnapshotStatusError,
+			timeout:       time.Minute,
+			expectedError: "snapshot fr-par-1/" + testSnapshotID + " failed",
+		},
+		{
+			name:          "snapshot still creating",
+			status:        block.SnapshotStatusCreating,
+			timeout:       10 * time.Millisecond,
+			expectedError: "timed out after 10ms waiting for snapshot fr-par-1/" + testSnapshotID + " to be available, last status creating",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := new(mockBlock)
+			defer b.AssertExpectations(t)
+
+			b.On("GetVolume", mock.Anything).Return(&block.Volume{ID: testVolumeID, Zone: scw.ZoneFrPar1}, nil)
+			b.On("CreateSnapshot", mock.Anything).Return(&block.Snapshot{ID: testSnapshotID, Zone: scw.ZoneFrPar1}, nil)
+			b.On("GetSnapshot", &block.GetSnapshotRequest{Zone: scw.ZoneFrPar1, SnapshotID: testSnapshotID}).Return(&block.Snapshot{Status: tc.status}, nil)
+			// the snapshot is unknown to Velero, so it is removed
+			b.On("DeleteSnapshot", &block.DeleteSnapshotRequest{Zone: scw.ZoneFrPar1, SnapshotID: testSnapshotID}).Return(nil).Once()
+
+			s := newTestVolumeSnapshotter(b)
+			s.snapshotTimeout = tc.timeout
+			_, err := s.CreateSnapshot("fr-par-1/"+testVolumeID, "backup", nil)
+			assert.EqualError(t, err, tc.expectedError)
+		})
+	}
+}
+
+func TestCreateVolumeFromSnapshot(t *testing.T) {
+	const restoredVolumeID = "33333333-3333-3333-3333-333333333333"
+	notFound := &scw.ResourceNotFoundError{Resource: "snapshot", ResourceID: testSnapshotID}
+
+	tests := []struct {
+		name       string
+		snapshotID string
+		volumeAZ   string
+		iops       uint32
+		// snapshots are the snapshot returned by every zone, fr-par-1 first
+		snapshots      []*block.Snapshot
+		volumeStatuses []block.VolumeStatus
+		timeout        time.Duration
+		expectedCreate *block.CreateVolumeRequest
+		expectedDelete bool
+		expectedError  string
+	}{
+		{
+			name:       "zoned snapshot",
+			snapshotID: "fr-par-2/" + testSnapshotID,
+			volumeAZ:   "fr-par-2",
+			iops:       5000,
+			snapshots: []*block.Snapshot{
+				{ID: testSnapshotID, Zone: scw.ZoneFrPar2, Status: block.SnapshotStatusAvailable, Tags: []string{"velero"}},
+			},
+			volumeStatuses: []block.VolumeStatus{block.VolumeStatusCreating, block.VolumeStatusAvailable},
+			expectedCreate: &block.CreateVolumeRequest{
+				Zone:         scw.ZoneFrPar2,
+				FromSnapshot: &block.CreateVolumeRequestFromSnapshot{SnapshotID: testSnapshotID},
+				PerfIops:     scw.Uint32Ptr(5000),
+				Tags:         []string{"velero"},
+			},
+		},
+		{
+			name:       "legacy snapshot without zone",
+			snapshotID: testSnapshotID,
+			snapshots: []*block.Snapshot{
+				nil,
+				{ID: testSnapshotID, Zone: scw.ZoneFrPar2, Status: block.SnapshotStatusAvailable},
+			},
+			volumeStatuses: []block.VolumeStatus{block.VolumeStatusAvailable},
+			expectedCreate: &block.CreateVolumeRequest{
+				Zone:         scw.ZoneFrPar2,
+				FromSnapshot: &block.CreateVolumeRequestFromSnapshot{SnapshotID: testSnapshotID},
+			},
+		},
+		{
+			name:       "snapshot not available",
+			snapshotID: "fr-par-1/" + testSnapshotID,
+			snapshots: []*block.Snapshot{
+				{ID: testSnapshotID, Zone: scw.ZoneFrPar1, Status: block.SnapshotStatusCreating},
+			},
+			expectedError: "snapshot fr-par-1/" + testSnapshotID + " is creating, expected available",
+		},
+		{
+			name:       "snapshot in another zone",
+			snapshotID: "fr-par-1/" + testSnapshotID,
+			volumeAZ:   "fr-par-2",
+			snapshots: []*block.Snapshot{
+				{ID: testSnapshotID, Zone: scw.ZoneFrPar1, Status: block.SnapshotStatusAvailable},
+			},
+			expectedError: "snapshot fr-par-1/" + testSnapshotID + " is in zone fr-par-1, it cannot be restored in zone fr-par-2",
+		},
+		{
+			name:       "volume in error",
+			snapshotID: "fr-par-1/" + testSnapshotID,
+			snapshots: []*block.Snapshot{
+				{ID: testSnapshotID, Zone: scw.ZoneFrPar1, Status: block.SnapshotStatusAvailable},
+			},
+			volumeStatuses: []block.VolumeStatus{block.VolumeStatusCreating, block.VolumeStatusError},
+			expectedCreate: &block.CreateVolumeRequest{
+				Zone:         scw.ZoneFrPar1,
+				FromSnapshot: &block.CreateVolumeRequestFromSnapshot{SnapshotID: testSnapshotID},
+			},
+			expectedDelete: true,
+			expectedError:  "volume fr-par-1/" + restoredVolumeID + " failed",
+		},
+		{
+			name:       "volume still creating",
+			snapshotID: "fr-par-1/" + testSnapshotID,
+			snapshots: []*block.Snapshot{
+				{ID: testSnapshotID, Zone: scw.ZoneFrPar1, Status: block.SnapshotStatusAvailable},
+			},
+			volumeStatuses: []block.VolumeStatus{block.VolumeStatusCreating},
+			timeout:        10 * time.Millisecond,
+			expectedCreate: &block.CreateVolumeRequest{
+				Zone:         scw.ZoneFrPar1,
+				FromSnapshot: &block.CreateVolumeRequestFromSnapshot{SnapshotID: testSnapshotID},
+			},
+			expectedDelete: true,
+			expectedError:  "timed out after 10ms waiting for volume fr-par-1/" + restoredVolumeID + " to be available, last status creating",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := new(mockBlock)
+			defer b.AssertExpectations(t)
+
+			for _, snapshot := range tc.snapshots {
+				if snapshot == nil {
+					b.On("GetSnapshot", &block.GetSnapshotRequest{Zone: scw.ZoneFrPar1, SnapshotID: testSnapshotID}).Return((*block.Snapshot)(nil), notFound).Once()
+					continue
+				}
+				b.On("GetSnapshot", &block.GetSnapshotRequest{Zone: snapshot.Zone, SnapshotID: testSnapshotID}).Return(snapshot, nil).Once()
+			}
+			if tc.expectedCreate != nil {
+				b.On("CreateVolume", tc.expectedCreate).Return(&block.Volume{ID: restoredVolumeID, Zone: tc.expectedCreate.Zone, Status: block.VolumeStatusCreating}, nil).Once()
+				getVolume := &block.GetVolumeRequest{Zone: tc.expectedCreate.Zone, VolumeID: restoredVolumeID}
+				for i, status := range tc.volumeStatuses {
+					call := b.On("GetVolume", getVolume).Return(&block.Volume{Status: status}, nil)
+					// the last status sticks
+					if i < len(tc.volumeStatuses)-1 {
+						call.Once()
+					}
+				}
+			}
+			if tc.expectedDelete {
+				b.On("DeleteVolume", &block.DeleteVolumeRequest{Zone: tc.expectedCreate.Zone, VolumeID: restoredVolumeID}).Return(nil).Once()
+			}
+
+			s := newTestVolumeSnapshotter(b)
+			if tc.timeout > 0 {
+				s.volumeTimeout = tc.timeout
+			}
+			volumeID, err := s.CreateVolumeFromSnapshot(tc.snapshotID, tc.volumeAZ, tc.iops)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
 			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedCreate.Zone.String()+"/"+restoredVolumeID, volumeID)
 		})
 	}
 }
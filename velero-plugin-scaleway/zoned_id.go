@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/scaleway/scaleway-sdk-go/scw"
+	"github.com/scaleway/scaleway-sdk-go/validation"
+)
+
+// zonedID identifies a zonal resource, a Block Storage volume or snapshot.
+// The SBS CSI driver writes the volume handles as <zone>/<uuid>, older handles
+// being a bare UUID whose zone is unknown. The volume and snapshot IDs the
+// plugin returns to Velero have the same shape, so a single VSL serves every
+// zone of its region.
+type zonedID struct {
+	zone scw.Zone
+	id   string
+}
+
+// parseZonedID parses a zoned or a bare UUID ID.
+func parseZonedID(s string) (zonedID, error) {
+	zone, id, zoned := strings.Cut(s, "/")
+	if !zoned {
+		zone, id = "", s
+	}
+	if zoned && !validation.IsZone(zone) {
+		return zonedID{}, errors.Errorf("invalid ID %q: %q is not a zone", s, zone)
+	}
+	if !validation.IsUUID(id) {
+		return zonedID{}, errors.Errorf("invalid ID %q: %q is not a UUID", s, id)
+	}
+	return zonedID{zone: scw.Zone(zone), id: strings.ToLower(id)}, nil
+}
+
+func (z zonedID) String() string {
+	if z.zone == "" {
+		return z.id
+	}
+	return z.zone.String() + "/" + z.id
+}